@@ -0,0 +1,33 @@
+package catalog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "consul_k8s"
+	metricsSubsystem = "sync_to_k8s"
+)
+
+var (
+	// metricOperations is the number of successful writes to Kubernetes by
+	// operation, such as "create", "update" and "delete".
+	metricOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "operations_total",
+		Help:      "Number of Kubernetes services created, updated and deleted.",
+	}, []string{"operation"})
+
+	// metricErrors is the number of failed writes to Kubernetes by operation.
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "errors_total",
+		Help:      "Number of failed Kubernetes API calls by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(metricOperations, metricErrors)
+}
@@ -2,20 +2,45 @@ package catalog
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul-k8s/helper/coalesce"
 	"github.com/hashicorp/go-hclog"
 	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
+	// endpointsPortName is the name of the port of the services created by
+	// the sink. The port of each endpoint subset has the same name so
+	// kube-proxy can map the service port to the instance ports.
+	endpointsPortName = "default"
+
+	// serviceNameHashLength is the length of the hash suffix added to
+	// translated service names that would otherwise collide.
+	serviceNameHashLength = 8
+
+	// serviceNamePrefix is the prefix added to translated service names
+	// that don't start with a letter.
+	serviceNamePrefix = "svc-"
+
 	// K8SQuietPeriod is the time to wait for no service changes before syncing.
 	K8SQuietPeriod = 1 * time.Second
 
@@ -24,15 +49,80 @@ const (
 	K8SMaxPeriod = 5 * time.Second
 )
 
+const (
+	// LabelManagedBy is the label set to LabelManagedByValue on the
+	// services and endpoints created by the sink. Only services with this
+	// label are updated or deleted by the sink.
+	LabelManagedBy      = "app.kubernetes.io/managed-by"
+	LabelManagedByValue = "consul-k8s-sync-catalog"
+
+	// LabelOwner is the label set to the Owner of the sink on the services
+	// and endpoints it creates, so that sinks writing to the same namespaces
+	// don't delete each other's services.
+	LabelOwner = "consul.hashicorp.com/sync-catalog-owner"
+
+	// AnnotationConsulService and AnnotationConsulDatacenter are the
+	// annotations that record the name and datacenter of the Consul service
+	// a service was created from. The name of the K8S service may differ
+	// since Consul names are translated to valid K8S names.
+	AnnotationConsulService    = "consul.hashicorp.com/consul-service-name"
+	AnnotationConsulDatacenter = "consul.hashicorp.com/consul-datacenter"
+
+	// AnnotationConsulTags and AnnotationConsulMeta are the annotations
+	// that record the tags of the Consul service, separated by commas, and
+	// the meta shared by all its instances, as a JSON object.
+	AnnotationConsulTags = "consul.hashicorp.com/consul-service-tags"
+	AnnotationConsulMeta = "consul.hashicorp.com/consul-service-meta"
+
+	// labelLegacyConsul is the label set on services created by earlier
+	// versions of the sink. These are only managed if adoption is enabled.
+	labelLegacyConsul = "consul"
+)
+
 // Sink is the destination where services are registered.
 //
 // While in practice we only have one sink (K8S), the interface abstraction
 // makes it easy and possible to test the Source in isolation.
 type Sink interface {
 	// SetServices is called with the services that should be created.
-	// The key is the service name and the destination is the external DNS
-	// entry to point to.
-	SetServices(map[string]string)
+	// The key is the service name in the sink.
+	SetServices(map[string]Service)
+}
+
+// Service is a Consul service to create in the sink.
+type Service struct {
+	// DNSName is the external DNS entry to point to.
+	DNSName string
+
+	// Name and Datacenter are the name and datacenter of the service in
+	// Consul.
+	Name       string
+	Datacenter string
+
+	// Tags are the tags of the instances of the service.
+	Tags []string
+
+	// Meta is the service meta shared by all instances of the service and
+	// Port is the port used by most of them, or zero if unknown.
+	Meta map[string]string
+	Port int
+}
+
+// EndpointsSink is a Sink that also registers the addresses of the
+// instances of each service.
+type EndpointsSink interface {
+	Sink
+
+	// SetEndpoints is called with the healthy instances of the service
+	// with the given name whenever they change. The name is the same as
+	// the key given to SetServices.
+	SetEndpoints(string, []Endpoint)
+}
+
+// Endpoint is the address and port of a single instance of a service.
+type Endpoint struct {
+	Address string
+	Port    int
 }
 
 // K8SSink is a Sink implementation that registers services with Kubernetes.
@@ -50,33 +140,123 @@ type K8SSink struct {
 	// done if there are no changes.
 	SyncPeriod time.Duration
 
+	// SyncEndpoints, if true, creates ClusterIP services without a selector
+	// along with an Endpoints resource containing the addresses given to
+	// SetEndpoints, rather than ExternalName services pointing to Consul DNS.
+	// This lets kube-proxy route directly to the Consul service instances.
+	// A service is only created once it has instances with a port.
+	SyncEndpoints bool
+
+	// EventRecorder, if set, records events on the Kubernetes services that
+	// couldn't be written, so they are visible in Kubernetes.
+	EventRecorder record.EventRecorder
+
+	// EventObject, if set, is the object to record events on for Consul
+	// services that can't be created at all, such as the pod the sink is
+	// running in. This must be a namespaced object so the events show up
+	// with it.
+	EventObject runtime.Object
+
+	// DryRun, if true, only logs the services and endpoints that would be
+	// created, updated or deleted without writing anything to Kubernetes.
+	DryRun bool
+
+	// LabelMetaKeys are the keys of the Consul service meta to add as labels
+	// to the services created by the sink. Values that aren't valid label
+	// values are skipped.
+	LabelMetaKeys []string
+
+	// NamespaceMetaKey, NamespaceTagPrefix and NamespacePrefixes choose the
+	// namespace to create each service in rather than Namespace. They are
+	// applied in that order and services that match none of them are
+	// created in Namespace. If any of them are set, then services in all
+	// namespaces are watched.
+	//
+	// NamespaceMetaKey is a Consul service meta key whose value is the
+	// namespace. This requires the meta of the services.
+	//
+	// NamespaceTagPrefix is a prefix of Consul service tags. The rest of the
+	// first tag with the prefix, in sorted order, is the namespace.
+	//
+	// NamespacePrefixes maps prefixes of Consul service names to namespaces.
+	// The longest matching prefix is used.
+	NamespaceMetaKey   string
+	NamespaceTagPrefix string
+	NamespacePrefixes  map[string]string
+
+	// AdoptServices, if true, manages existing services with the legacy
+	// "consul=true" label as if they were created by the sink, such as
+	// services created by earlier versions. Otherwise only services with
+	// the LabelManagedBy label are updated or deleted.
+	AdoptServices bool
+
+	// Owner, if set, identifies this sink among the sinks writing to the
+	// same cluster, such as other installs syncing other datacenters. It is
+	// set as the LabelOwner label on the services created by the sink and
+	// only services with the same owner are updated or deleted. Services
+	// without an owner, such as those created by earlier versions, are only
+	// managed in Namespace.
+	Owner string
+
+	// sourceServices and sourceEndpoints are keyed by the name given to
+	// SetServices. The other maps are keyed by the "namespace/name" key of
+	// the services in K8S.
 	lock             sync.Mutex
-	sourceServices   map[string]string
-	keyToName        map[string]string
+	sourceServices   map[string]Service
+	sourceEndpoints  map[string][]Endpoint
+	endpointsMap     map[string][]Endpoint // endpoints last written to K8S
 	serviceMap       map[string]struct{}
 	serviceMapConsul map[string]*apiv1.Service
+	skippedServices  map[string]struct{} // services reported as skipped
 	triggerCh        chan struct{}
 	readyCh          chan struct{}
 }
 
+// sinkService is a service to create in K8S.
+type sinkService struct {
+	Namespace string
+	Name      string // the name given to SetServices
+	K8SName   string // the name of the service in K8S
+	Service   Service
+}
+
 // SetServices implements Sink
-func (s *K8SSink) SetServices(svcs map[string]string) {
+func (s *K8SSink) SetServices(svcs map[string]Service) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.sourceServices = svcs
+
+	// Forget the endpoints of services that no longer exist.
+	for name := range s.sourceEndpoints {
+		if _, ok := svcs[name]; !ok {
+			delete(s.sourceEndpoints, name)
+		}
+	}
+
 	s.trigger() // Any service change probably requires syncing
 }
 
+// SetEndpoints implements EndpointsSink
+func (s *K8SSink) SetEndpoints(name string, endpoints []Endpoint) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sourceEndpoints == nil {
+		s.sourceEndpoints = make(map[string][]Endpoint)
+	}
+	s.sourceEndpoints[name] = endpoints
+	s.trigger()
+}
+
 // Informer implements the controller.Resource interface.
 func (s *K8SSink) Informer() cache.SharedIndexInformer {
 	return cache.NewSharedIndexInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return s.Client.CoreV1().Services(s.namespace()).List(options)
+				return s.Client.CoreV1().Services(s.watchNamespace()).List(options)
 			},
 
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return s.Client.CoreV1().Services(s.namespace()).Watch(options)
+				return s.Client.CoreV1().Services(s.watchNamespace()).Watch(options)
 			},
 		},
 		&apiv1.Service{},
@@ -97,27 +277,25 @@ func (s *K8SSink) Upsert(key string, raw interface{}) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	// Store all the key to name mappings. We need this because the key
-	// is opaque but we want to do all the lookups by service name.
-	if s.keyToName == nil {
-		s.keyToName = make(map[string]string)
-	}
-	s.keyToName[key] = service.Name
-
 	if s.serviceMap == nil {
 		s.serviceMap = make(map[string]struct{})
 	}
-	s.serviceMap[service.Name] = struct{}{}
+	s.serviceMap[key] = struct{}{}
 
 	// If the service is a Consul-sourced service, then keep track of it
 	// separately for a quick lookup.
-	if service.Labels != nil && service.Labels["consul"] == "true" {
+	if s.managed(service.Namespace, service.Labels) {
 		if s.serviceMapConsul == nil {
 			s.serviceMapConsul = make(map[string]*apiv1.Service)
 		}
 
-		s.serviceMapConsul[service.Name] = service
+		s.serviceMapConsul[key] = service
 		s.trigger() // Always trigger sync
+	} else if _, ok := s.serviceMapConsul[key]; ok {
+		// The service is no longer managed, for example because its labels
+		// were changed, so it must never be updated or deleted.
+		delete(s.serviceMapConsul, key)
+		s.trigger()
 	}
 
 	s.Log.Info("upsert", "key", key)
@@ -129,27 +307,18 @@ func (s *K8SSink) Delete(key string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	name, ok := s.keyToName[key]
-	if !ok {
-		// This is a weird scenario, but in unit tests we've seen this happen
-		// in cases where the delete happens very quickly after the create.
-		// Just to be sure, lets trigger a sync. This is cheap cause it'll
-		// do nothing if there is no work to be done.
-		s.trigger()
-		return nil
-	}
+	delete(s.serviceMap, key)
+	delete(s.serviceMapConsul, key)
 
-	delete(s.keyToName, key)
-	delete(s.serviceMap, name)
-	delete(s.serviceMapConsul, name)
+	// Make sure the endpoints are written again if the service is recreated.
+	delete(s.endpointsMap, key)
 
-	// If the service that is deleted is part of Consul services, then
-	// we need to trigger a sync to recreate it.
-	if _, ok := s.sourceServices[name]; ok {
-		s.trigger()
-	}
+	// If the service that is deleted is part of Consul services, then we
+	// need to trigger a sync to recreate it. This is cheap since it'll do
+	// nothing if there is no work to be done.
+	s.trigger()
 
-	s.Log.Info("delete", "key", key, "name", name)
+	s.Log.Info("delete", "key", key)
 	return nil
 }
 
@@ -189,49 +358,164 @@ func (s *K8SSink) Run(ch <-chan struct{}) {
 		s.lock.Unlock()
 		s.Log.Debug("sync triggered", "create", len(create), "update", len(update), "delete", len(delete))
 
-		svcClient := s.Client.CoreV1().Services(s.namespace())
-		for _, name := range delete {
-			if err := svcClient.Delete(name, nil); err != nil {
-				s.Log.Warn("error deleting service", "name", name, "error", err)
+		if s.DryRun {
+			s.logPlan(create, update, delete)
+			continue
+		}
+
+		for _, key := range delete {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+			if err := s.Client.CoreV1().Services(namespace).Delete(name, nil); err != nil {
+				metricErrors.WithLabelValues("delete").Inc()
+				s.Log.Warn("error deleting service", "key", key, "error", err)
+				s.recordEvent(key, apiv1.EventTypeWarning, "DeleteFailed",
+					"failed to delete service synced from Consul: %s", err)
+				continue
 			}
+
+			metricOperations.WithLabelValues("delete").Inc()
 		}
 
 		for _, svc := range update {
-			_, err := svcClient.Update(svc)
+			_, err := s.Client.CoreV1().Services(svc.Namespace).Update(svc)
 			if err != nil {
-				s.Log.Warn("error updating service", "name", svc.Name, "error", err)
+				metricErrors.WithLabelValues("update").Inc()
+				s.Log.Warn("error updating service", "key", serviceKey(svc), "error", err)
+				s.recordEvent(serviceKey(svc), apiv1.EventTypeWarning, "UpdateFailed",
+					"failed to update service synced from Consul: %s", err)
+				continue
 			}
+
+			metricOperations.WithLabelValues("update").Inc()
 		}
 
 		for _, svc := range create {
-			_, err := svcClient.Create(svc)
+			_, err := s.Client.CoreV1().Services(svc.Namespace).Create(svc)
 			if err != nil {
-				s.Log.Warn("error creating service", "name", svc.Name, "error", err)
+				metricErrors.WithLabelValues("create").Inc()
+				s.Log.Warn("error creating service", "key", serviceKey(svc), "error", err)
+				s.recordSinkEvent(apiv1.EventTypeWarning, "CreateFailed",
+					"failed to create service %q synced from Consul: %s", serviceKey(svc), err)
+				continue
+			}
+
+			metricOperations.WithLabelValues("create").Inc()
+		}
+
+		if !s.SyncEndpoints {
+			continue
+		}
+
+		s.lock.Lock()
+		endpoints := s.endpointsList()
+		s.lock.Unlock()
+		s.Log.Debug("endpoints sync triggered", "update", len(endpoints), "delete", len(delete))
+
+		for _, key := range delete {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+			err := s.Client.CoreV1().Endpoints(namespace).Delete(name, nil)
+			if err != nil && !apierrors.IsNotFound(err) {
+				metricErrors.WithLabelValues("delete-endpoints").Inc()
+				s.Log.Warn("error deleting endpoints", "key", key, "error", err)
 			}
 		}
+
+		for key, eps := range endpoints {
+			if err := s.writeEndpoints(key, eps); err != nil {
+				metricErrors.WithLabelValues("write-endpoints").Inc()
+				s.Log.Warn("error writing endpoints", "key", key, "error", err)
+				s.recordEvent(key, apiv1.EventTypeWarning, "EndpointsFailed",
+					"failed to write endpoints synced from Consul: %s", err)
+				continue
+			}
+
+			metricOperations.WithLabelValues("write-endpoints").Inc()
+
+			s.lock.Lock()
+			if s.endpointsMap == nil {
+				s.endpointsMap = make(map[string][]Endpoint)
+			}
+			s.endpointsMap[key] = eps
+			s.lock.Unlock()
+		}
+	}
+}
+
+// logPlan logs the given services to create, update and delete, along with
+// the endpoints to write, instead of writing them.
+func (s *K8SSink) logPlan(create, update []*apiv1.Service, delete []string) {
+	for _, key := range delete {
+		s.Log.Info("dry run: would delete service", "key", key)
+	}
+
+	for _, svc := range update {
+		s.Log.Info("dry run: would update service", "key", serviceKey(svc), "spec", planJSON(svc.Spec))
+	}
+
+	for _, svc := range create {
+		s.Log.Info("dry run: would create service", "key", serviceKey(svc), "spec", planJSON(svc.Spec))
+	}
+
+	if !s.SyncEndpoints {
+		return
+	}
+
+	s.lock.Lock()
+	endpoints := s.endpointsList()
+	s.lock.Unlock()
+	for key, eps := range endpoints {
+		s.Log.Info("dry run: would write endpoints", "key", key, "endpoints", planJSON(eps))
 	}
 }
 
+// planJSON returns the JSON encoding of the given value for logging the
+// plan of a dry run.
+func planJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+
+	return string(b)
+}
+
 // crudList returns the services to create, update, and delete (respectively).
 func (s *K8SSink) crudList() ([]*apiv1.Service, []*apiv1.Service, []string) {
 	var create, update []*apiv1.Service
 	var delete []string
 
 	// Determine what needs to be created or updated
-	for k, v := range s.sourceServices {
+	desired := s.desiredServices()
+	for k, d := range desired {
+		v := d.Service
+		spec, ok := s.serviceSpec(d.Name, v)
+		if !ok {
+			s.Log.Debug("not enough information to sync service yet", "key", k)
+			continue
+		}
+
 		// If this is an already registered service, then update it
 		if s.serviceMapConsul != nil {
 			if svc, ok := s.serviceMapConsul[k]; ok {
-				if svc.Spec.ExternalName == v {
+				labels, annotations := s.serviceMetadata(v)
+				if serviceSpecEqual(svc.Spec, spec) && s.metadataEqual(svc, labels, annotations) {
 					// Matching service, no update required.
 					continue
 				}
 
-				svc.Spec = apiv1.ServiceSpec{
-					Type:         apiv1.ServiceTypeExternalName,
-					ExternalName: v,
+				// Copy so we don't modify the informer's cache. Setting the
+				// metadata also records the ownership of adopted services.
+				svc = svc.DeepCopy()
+				s.setMetadata(svc, labels, annotations)
+
+				// The cluster IP can't be changed once it is allocated.
+				if svc.Spec.Type == apiv1.ServiceTypeClusterIP &&
+					spec.Type == apiv1.ServiceTypeClusterIP {
+					spec.ClusterIP = svc.Spec.ClusterIP
 				}
 
+				svc.Spec = spec
+
 				update = append(update, svc)
 				continue
 			}
@@ -239,31 +523,36 @@ func (s *K8SSink) crudList() ([]*apiv1.Service, []*apiv1.Service, []string) {
 
 		// If this is a registered K8S service, ignore.
 		if _, ok := s.serviceMap[k]; ok {
-			s.Log.Warn("service already registered in K8S, not registering", "name", k)
+			s.Log.Warn("service already registered in K8S, not registering", "key", k)
+			s.recordEvent(k, apiv1.EventTypeWarning, "ServiceExists",
+				"service already registered in K8S, not registering Consul service %q", v.DNSName)
 			continue
 		}
 
 		// Register!
-		create = append(create, &apiv1.Service{
+		svc := &apiv1.Service{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:   k,
-				Labels: map[string]string{"consul": "true"},
+				Name:      d.K8SName,
+				Namespace: d.Namespace,
+				Labels: map[string]string{
+					labelLegacyConsul: "true",
+				},
 				Annotations: map[string]string{
 					// Ensure we don't sync the service back to Consul
 					"consul.hashicorp.com/service-sync": "false",
 				},
 			},
 
-			Spec: apiv1.ServiceSpec{
-				Type:         apiv1.ServiceTypeExternalName,
-				ExternalName: v,
-			},
-		})
+			Spec: spec,
+		}
+		labels, annotations := s.serviceMetadata(v)
+		s.setMetadata(svc, labels, annotations)
+		create = append(create, svc)
 	}
 
 	// Determine what needs to be deleted
 	for k, _ := range s.serviceMapConsul {
-		if _, ok := s.sourceServices[k]; !ok {
+		if _, ok := desired[k]; !ok {
 			delete = append(delete, k)
 		}
 	}
@@ -271,6 +560,495 @@ func (s *K8SSink) crudList() ([]*apiv1.Service, []*apiv1.Service, []string) {
 	return create, update, delete
 }
 
+// desiredServices returns the services that should exist in K8S, keyed by
+// their "namespace/name" key. Lock must be held.
+func (s *K8SSink) desiredServices() map[string]sinkService {
+	// Sort the names so collisions are resolved the same way every time.
+	names := make([]string, 0, len(s.sourceServices))
+	for name := range s.sourceServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Group the services by key first so we know which translated names
+	// collide with others.
+	groups := make(map[string][]sinkService)
+	var keys []string
+	skipped := make(map[string]struct{})
+	for _, name := range names {
+		svc := s.sourceServices[name]
+		ns := s.serviceNamespace(svc)
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			s.skipService(name, s.namespace(),
+				"invalid namespace %q: %s", ns, strings.Join(errs, "; "))
+			skipped[name] = struct{}{}
+			continue
+		}
+
+		k8sName, ok := k8sServiceName(name)
+		if !ok {
+			s.skipService(name, ns, "name can't be translated to a valid Kubernetes service name")
+			skipped[name] = struct{}{}
+			continue
+		}
+
+		key := ns + "/" + k8sName
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], sinkService{
+			Namespace: ns,
+			Name:      name,
+			K8SName:   k8sName,
+			Service:   svc,
+		})
+	}
+
+	// Translated names that collide with another name get a hash suffix.
+	// A name that didn't need translating always keeps its name.
+	result := make(map[string]sinkService, len(s.sourceServices))
+	for _, key := range keys {
+		group := groups[key]
+		for _, d := range group {
+			if len(group) > 1 && d.K8SName != d.Name {
+				d.K8SName = hashedServiceName(d.K8SName, d.Name)
+			}
+
+			k := d.Namespace + "/" + d.K8SName
+			if _, ok := result[k]; ok {
+				s.skipService(d.Name, d.Namespace,
+					"name %q collides with another service", d.K8SName)
+				skipped[d.Name] = struct{}{}
+				continue
+			}
+
+			result[k] = d
+		}
+	}
+
+	// Report services again if they are skipped after being fixed.
+	for name := range s.skippedServices {
+		if _, ok := skipped[name]; !ok {
+			delete(s.skippedServices, name)
+		}
+	}
+
+	return result
+}
+
+// skipService logs and records an event on the EventObject for a service
+// that can't be created in the given namespace. This is only done once for
+// each service so it doesn't happen on every sync. Lock must be held.
+func (s *K8SSink) skipService(name, namespace, messageFmt string, args ...interface{}) {
+	if _, ok := s.skippedServices[name]; ok {
+		return
+	}
+	if s.skippedServices == nil {
+		s.skippedServices = make(map[string]struct{})
+	}
+	s.skippedServices[name] = struct{}{}
+
+	msg := fmt.Sprintf(messageFmt, args...)
+	s.Log.Warn("skipping service synced from Consul",
+		"name", name, "namespace", namespace, "reason", msg)
+	s.recordSinkEvent(apiv1.EventTypeWarning, "ServiceSkipped",
+		"not registering Consul service %q in namespace %q: %s", name, namespace, msg)
+}
+
+// serviceNamespace returns the namespace to create the K8S service for the
+// given Consul service in.
+func (s *K8SSink) serviceNamespace(svc Service) string {
+	if s.NamespaceMetaKey != "" {
+		if ns, ok := svc.Meta[s.NamespaceMetaKey]; ok {
+			return ns
+		}
+	}
+
+	if s.NamespaceTagPrefix != "" {
+		tags := make([]string, len(svc.Tags))
+		copy(tags, svc.Tags)
+		sort.Strings(tags)
+		for _, t := range tags {
+			if strings.HasPrefix(t, s.NamespaceTagPrefix) {
+				return strings.TrimPrefix(t, s.NamespaceTagPrefix)
+			}
+		}
+	}
+
+	var prefix, ns string
+	for p, v := range s.NamespacePrefixes {
+		if strings.HasPrefix(svc.Name, p) && (ns == "" || len(p) > len(prefix)) {
+			prefix, ns = p, v
+		}
+	}
+	if ns != "" {
+		return ns
+	}
+
+	return s.namespace()
+}
+
+// serviceSpec returns the spec of the service with the given name. This
+// returns false if there isn't enough information to create the service
+// yet.
+func (s *K8SSink) serviceSpec(name string, svc Service) (apiv1.ServiceSpec, bool) {
+	if !s.SyncEndpoints {
+		spec := apiv1.ServiceSpec{
+			Type:         apiv1.ServiceTypeExternalName,
+			ExternalName: svc.DNSName,
+		}
+		if svc.Port > 0 {
+			spec.Ports = servicePorts(svc.Port)
+		}
+
+		return spec, true
+	}
+
+	// Kubernetes requires a port for ClusterIP services, so we can't
+	// create the service until we know the port of the instances.
+	port := commonPort(s.sourceEndpoints[name])
+	if port == 0 {
+		port = svc.Port
+	}
+	if port == 0 {
+		return apiv1.ServiceSpec{}, false
+	}
+
+	return apiv1.ServiceSpec{
+		Type:  apiv1.ServiceTypeClusterIP,
+		Ports: servicePorts(port),
+	}, true
+}
+
+// servicePorts returns the ports of a service created by the sink for
+// instances with the given port.
+func servicePorts(port int) []apiv1.ServicePort {
+	return []apiv1.ServicePort{
+		apiv1.ServicePort{
+			Name:       endpointsPortName,
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(port),
+		},
+	}
+}
+
+// endpointsList returns the endpoints that need to be written to K8S,
+// keyed by the "namespace/name" key of the service. Lock must be held.
+func (s *K8SSink) endpointsList() map[string][]Endpoint {
+	desired := s.desiredServices()
+
+	// Forget about the endpoints of services that are being removed.
+	for key := range s.endpointsMap {
+		if _, ok := desired[key]; !ok {
+			delete(s.endpointsMap, key)
+		}
+	}
+
+	result := make(map[string][]Endpoint)
+	for key, d := range desired {
+		eps, ok := s.sourceEndpoints[d.Name]
+		if !ok {
+			continue
+		}
+
+		// Never write endpoints for services that we didn't create.
+		if _, ok := s.serviceMap[key]; ok {
+			if _, ok := s.serviceMapConsul[key]; !ok {
+				continue
+			}
+		}
+
+		if current, ok := s.endpointsMap[key]; ok && reflect.DeepEqual(current, eps) {
+			continue
+		}
+
+		result[key] = eps
+	}
+
+	return result
+}
+
+// writeEndpoints creates or updates the Endpoints resource for the service
+// with the given key. The instances are grouped into one subset per port.
+func (s *K8SSink) writeEndpoints(key string, eps []Endpoint) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	var ports []int
+	addrs := make(map[int][]apiv1.EndpointAddress)
+	for _, ep := range eps {
+		// Kubernetes only supports IP addresses in endpoints.
+		if ep.Port == 0 || net.ParseIP(ep.Address) == nil {
+			continue
+		}
+
+		if _, ok := addrs[ep.Port]; !ok {
+			ports = append(ports, ep.Port)
+		}
+		addrs[ep.Port] = append(addrs[ep.Port], apiv1.EndpointAddress{IP: ep.Address})
+	}
+	sort.Ints(ports)
+
+	var subsets []apiv1.EndpointSubset
+	for _, port := range ports {
+		subsets = append(subsets, apiv1.EndpointSubset{
+			Addresses: addrs[port],
+			Ports: []apiv1.EndpointPort{
+				apiv1.EndpointPort{Name: endpointsPortName, Port: int32(port)},
+			},
+		})
+	}
+
+	client := s.Client.CoreV1().Endpoints(namespace)
+	existing, err := client.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: s.endpointsLabels(map[string]string{
+					labelLegacyConsul: "true",
+				}),
+			},
+			Subsets: subsets,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.managed(namespace, existing.Labels) {
+		return fmt.Errorf("endpoints %q exist and were not created by the sync", name)
+	}
+
+	existing = existing.DeepCopy()
+	existing.Labels = s.endpointsLabels(existing.Labels)
+	existing.Subsets = subsets
+	_, err = client.Update(existing)
+	return err
+}
+
+// serviceSpecEqual returns true if the actual spec of a service matches
+// the expected spec generated by the sink. Fields set by Kubernetes, such
+// as the cluster IP, are ignored.
+func serviceSpecEqual(actual, expected apiv1.ServiceSpec) bool {
+	if actual.Type != expected.Type ||
+		actual.ExternalName != expected.ExternalName ||
+		len(actual.Ports) != len(expected.Ports) {
+		return false
+	}
+
+	for i, p := range expected.Ports {
+		if actual.Ports[i].Name != p.Name ||
+			actual.Ports[i].Port != p.Port ||
+			actual.Ports[i].TargetPort != p.TargetPort {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commonPort returns the port used by most of the given endpoints, or
+// zero if none of them have a port. Ties are broken by the lowest port.
+func commonPort(eps []Endpoint) int {
+	counts := make(map[int]int)
+	for _, ep := range eps {
+		if ep.Port > 0 {
+			counts[ep.Port]++
+		}
+	}
+
+	var port int
+	for p, c := range counts {
+		if c > counts[port] || (c == counts[port] && p < port) {
+			port = p
+		}
+	}
+
+	return port
+}
+
+// recordEvent records an event on the service with the given
+// "namespace/name" key.
+func (s *K8SSink) recordEvent(key, eventType, reason, messageFmt string, args ...interface{}) {
+	if s.EventRecorder == nil {
+		return
+	}
+
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	s.EventRecorder.Eventf(&apiv1.ObjectReference{
+		Kind:      "Service",
+		Namespace: namespace,
+		Name:      name,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// recordSinkEvent records an event on the EventObject, for events about
+// services that don't exist in K8S.
+func (s *K8SSink) recordSinkEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if s.EventRecorder == nil || s.EventObject == nil {
+		return
+	}
+
+	s.EventRecorder.Eventf(s.EventObject, eventType, reason, messageFmt, args...)
+}
+
+// managed returns true if a resource with the given labels in the given
+// namespace is managed by the sink, either because it was created by the
+// sink or because it is adopted.
+func (s *K8SSink) managed(namespace string, labels map[string]string) bool {
+	if !s.owned(namespace, labels) {
+		return false
+	}
+
+	if labels[LabelManagedBy] == LabelManagedByValue {
+		return true
+	}
+
+	return s.AdoptServices && labels[labelLegacyConsul] == "true"
+}
+
+// owned returns true if a resource with the given labels in the given
+// namespace belongs to this sink rather than to another sink writing to
+// the same cluster. Resources without an owner belong to the sink that
+// writes to their namespace by default.
+func (s *K8SSink) owned(namespace string, labels map[string]string) bool {
+	if s.Owner == "" {
+		return true
+	}
+
+	if owner, ok := labels[LabelOwner]; ok {
+		return owner == s.Owner
+	}
+
+	return namespace == s.namespace()
+}
+
+// endpointsLabels returns a copy of the given labels of an Endpoints
+// resource with the labels set by the sink added.
+func (s *K8SSink) endpointsLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range labels {
+		result[k] = v
+	}
+
+	result[LabelManagedBy] = LabelManagedByValue
+	if s.Owner != "" {
+		result[LabelOwner] = s.Owner
+	}
+
+	return result
+}
+
+// serviceMetadata returns the labels and annotations of the service
+// created from the given Consul service.
+func (s *K8SSink) serviceMetadata(source Service) (map[string]string, map[string]string) {
+	labels := map[string]string{
+		LabelManagedBy: LabelManagedByValue,
+	}
+	if s.Owner != "" {
+		labels[LabelOwner] = s.Owner
+	}
+	for _, k := range s.LabelMetaKeys {
+		v, ok := source.Meta[k]
+		if !ok {
+			continue
+		}
+		if len(validation.IsQualifiedName(k)) > 0 || len(validation.IsValidLabelValue(v)) > 0 {
+			s.Log.Debug("meta is not a valid label, skipping",
+				"name", source.Name, "key", k, "value", v)
+			continue
+		}
+
+		labels[k] = v
+	}
+
+	annotations := map[string]string{
+		AnnotationConsulService:    source.Name,
+		AnnotationConsulDatacenter: source.Datacenter,
+	}
+	if len(source.Tags) > 0 {
+		tags := make([]string, len(source.Tags))
+		copy(tags, source.Tags)
+		sort.Strings(tags)
+		annotations[AnnotationConsulTags] = strings.Join(tags, ",")
+	}
+	if len(source.Meta) > 0 {
+		// Maps are encoded with sorted keys so this is deterministic, and
+		// encoding a map of strings can't fail.
+		b, _ := json.Marshal(source.Meta)
+		annotations[AnnotationConsulMeta] = string(b)
+	}
+
+	return labels, annotations
+}
+
+// managedLabels and managedAnnotations return the keys of the labels and
+// annotations that are set by the sink. Other keys are left untouched so
+// they can be set by users.
+func (s *K8SSink) managedLabels() []string {
+	return append([]string{LabelManagedBy, LabelOwner}, s.LabelMetaKeys...)
+}
+
+func (s *K8SSink) managedAnnotations() []string {
+	return []string{
+		AnnotationConsulService,
+		AnnotationConsulDatacenter,
+		AnnotationConsulTags,
+		AnnotationConsulMeta,
+	}
+}
+
+// metadataEqual returns true if the managed labels and annotations of the
+// given service are equal to the given labels and annotations.
+func (s *K8SSink) metadataEqual(svc *apiv1.Service, labels, annotations map[string]string) bool {
+	return mapKeysEqual(svc.Labels, labels, s.managedLabels()) &&
+		mapKeysEqual(svc.Annotations, annotations, s.managedAnnotations())
+}
+
+// setMetadata sets the managed labels and annotations of the given service
+// to the given labels and annotations, removing those that aren't set.
+func (s *K8SSink) setMetadata(svc *apiv1.Service, labels, annotations map[string]string) {
+	if svc.Labels == nil {
+		svc.Labels = make(map[string]string)
+	}
+	setMapKeys(svc.Labels, labels, s.managedLabels())
+
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	setMapKeys(svc.Annotations, annotations, s.managedAnnotations())
+}
+
+// mapKeysEqual returns true if the given keys have the same values in
+// both maps, including being absent.
+func mapKeysEqual(actual, expected map[string]string, keys []string) bool {
+	for _, k := range keys {
+		a, aok := actual[k]
+		e, eok := expected[k]
+		if a != e || aok != eok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setMapKeys sets the given keys of dst to their values in src, deleting
+// the keys that are absent in src.
+func setMapKeys(dst, src map[string]string, keys []string) {
+	for _, k := range keys {
+		if v, ok := src[k]; ok {
+			dst[k] = v
+		} else {
+			delete(dst, k)
+		}
+	}
+}
+
 // namespace returns the K8S namespace to setup the resource watchers in.
 func (s *K8SSink) namespace() string {
 	if s.Namespace != "" {
@@ -282,6 +1060,75 @@ func (s *K8SSink) namespace() string {
 	return metav1.NamespaceDefault
 }
 
+// watchNamespace returns the K8S namespace to watch services in. This is
+// all namespaces if services may be created outside of the namespace of
+// the sink.
+func (s *K8SSink) watchNamespace() string {
+	if s.NamespaceMetaKey != "" || s.NamespaceTagPrefix != "" || len(s.NamespacePrefixes) > 0 {
+		return metav1.NamespaceAll
+	}
+
+	return s.namespace()
+}
+
+// k8sServiceName translates the given Consul service name to a valid K8S
+// service name, which must be a DNS-1035 label. Valid names are returned
+// as is. Otherwise the name is lowercased, invalid characters are replaced
+// with "-" and names that don't start with a letter are given a prefix.
+// Names that are too long are truncated and given a hash suffix so they
+// stay unique. This returns false if the name can't be translated.
+func k8sServiceName(name string) (string, bool) {
+	if len(validation.IsDNS1035Label(name)) == 0 {
+		return name, true
+	}
+
+	result := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+	result = strings.Trim(result, "-")
+	if result == "" {
+		return "", false
+	}
+
+	// Names must start with a letter, so a prefix is added rather than
+	// dropping the leading digits.
+	if result[0] < 'a' || result[0] > 'z' {
+		result = serviceNamePrefix + result
+	}
+
+	if len(result) > validation.DNS1035LabelMaxLength {
+		result = hashedServiceName(result, name)
+	}
+
+	return result, true
+}
+
+// hashedServiceName returns the translated name with a suffix of the hash
+// of the original name, truncating it so the result is a valid name.
+func hashedServiceName(translated, original string) string {
+	sum := sha256.Sum256([]byte(original))
+	suffix := hex.EncodeToString(sum[:])[:serviceNameHashLength]
+
+	max := validation.DNS1035LabelMaxLength - len(suffix) - 1
+	if len(translated) > max {
+		translated = strings.TrimRight(translated[:max], "-")
+	}
+
+	return translated + "-" + suffix
+}
+
+// serviceKey returns the "namespace/name" key of the given service.
+func serviceKey(svc *apiv1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
 // trigger will notify a sync should occur. lock must be held.
 //
 // This is not synchronous and does not guarantee a sync will happen. This
@@ -1,7 +1,9 @@
 package catalog
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul-k8s/helper/controller"
 	"github.com/hashicorp/consul/sdk/testutil/retry"
@@ -9,8 +11,12 @@ import (
 	"github.com/stretchr/testify/require"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 func init() {
@@ -34,7 +40,7 @@ func TestK8SSink_create(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	var actual *apiv1.ServiceList
@@ -61,6 +67,468 @@ func TestK8SSink_create(t *testing.T) {
 	require.True(found, "found service")
 }
 
+// Test that nothing is written in a dry run.
+func TestK8SSink_dryRun(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink := &K8SSink{
+		Client: client,
+		Log:    hclog.Default(),
+		DryRun: true,
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+
+	// Wait for the sync to run
+	time.Sleep(2 * K8SQuietPeriod)
+
+	// Verify no service was created
+	list, err := client.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	require.NoError(err)
+	require.Len(list.Items, 0)
+}
+
+// Test that created services record their owner and source.
+func TestK8SSink_createOwner(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink, closer := testSink(t, client)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{"web": {
+		DNSName:    "web.service.local.",
+		Name:       "web",
+		Datacenter: "dc1",
+	}})
+
+	// Verify service gets registered
+	var actual *apiv1.Service
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		actual, err = client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+	})
+
+	require.Equal(LabelManagedByValue, actual.Labels[LabelManagedBy])
+	require.Equal("web", actual.Annotations[AnnotationConsulService])
+	require.Equal("dc1", actual.Annotations[AnnotationConsulDatacenter])
+}
+
+// Test that services are created and updated with the details of the
+// Consul service.
+func TestK8SSink_serviceDetails(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink := &K8SSink{
+		Client:        client,
+		Log:           hclog.Default(),
+		LabelMetaKeys: []string{"team"},
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{"web": {
+		DNSName: "web.service.local.",
+		Name:    "web",
+		Tags:    []string{"v2", "v1"},
+		Meta:    map[string]string{"team": "frontend", "version": "1"},
+		Port:    8080,
+	}})
+
+	// Verify service gets registered
+	var actual *apiv1.Service
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		actual, err = client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+	})
+
+	require.Len(actual.Spec.Ports, 1)
+	require.Equal(int32(8080), actual.Spec.Ports[0].Port)
+	require.Equal("frontend", actual.Labels["team"])
+	require.NotContains(actual.Labels, "version")
+	require.Equal("v1,v2", actual.Annotations[AnnotationConsulTags])
+	require.Equal(`{"team":"frontend","version":"1"}`, actual.Annotations[AnnotationConsulMeta])
+
+	// Remove the meta
+	sink.SetServices(map[string]Service{"web": {
+		DNSName: "web.service.local.",
+		Name:    "web",
+		Port:    8080,
+	}})
+
+	// Verify the labels and annotations are removed
+	retry.Run(t, func(r *retry.R) {
+		actual, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if _, ok := actual.Labels["team"]; ok {
+			r.Fatal("label not removed")
+		}
+		if _, ok := actual.Annotations[AnnotationConsulMeta]; ok {
+			r.Fatal("annotation not removed")
+		}
+	})
+}
+
+// Test that services with the legacy label are only managed if adopted.
+func TestK8SSink_namespaceRules(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink := &K8SSink{
+		Client:             client,
+		Log:                hclog.Default(),
+		NamespaceMetaKey:   "k8s-namespace",
+		NamespaceTagPrefix: "k8s-ns-",
+		NamespacePrefixes:  map[string]string{"db": "data", "db-cache": "cache"},
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set the services
+	sink.SetServices(map[string]Service{
+		"web": {
+			DNSName: "web.service.local.",
+			Name:    "web",
+			Tags:    []string{"k8s-ns-team-b"},
+			Meta:    map[string]string{"k8s-namespace": "team-a"},
+		},
+		"api":          {DNSName: "api.service.local.", Name: "api", Tags: []string{"k8s-ns-team-b"}},
+		"db-main":      {DNSName: "db-main.service.local.", Name: "db-main"},
+		"db-cache-one": {DNSName: "db-cache-one.service.local.", Name: "db-cache-one"},
+		"other":        {DNSName: "other.service.local.", Name: "other"},
+		"invalid":      {DNSName: "invalid.service.local.", Name: "invalid", Tags: []string{"k8s-ns-NOT_VALID"}},
+	})
+
+	// Verify the services get registered in their namespaces
+	expected := map[string]string{
+		"web":          "team-a",
+		"api":          "team-b",
+		"db-main":      "data",
+		"db-cache-one": "cache",
+		"other":        metav1.NamespaceDefault,
+	}
+	for name, ns := range expected {
+		retry.Run(t, func(r *retry.R) {
+			_, err := client.CoreV1().Services(ns).Get(name, metav1.GetOptions{})
+			if err != nil {
+				r.Fatalf("err: %s", err)
+			}
+		})
+	}
+
+	// Services with an invalid namespace are not registered
+	list, err := client.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	require.NoError(err)
+	require.Len(list.Items, len(expected))
+
+	// Move a service to another namespace
+	sink.SetServices(map[string]Service{
+		"web": {DNSName: "web.service.local.", Name: "web", Meta: map[string]string{"k8s-namespace": "team-c"}},
+	})
+
+	// Verify the service is moved and the others are removed
+	retry.Run(t, func(r *retry.R) {
+		list, err := client.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(list.Items) != 1 {
+			r.Fatalf("bad: %#v", list.Items)
+		}
+		if list.Items[0].Namespace != "team-c" {
+			r.Fatalf("bad namespace: %s", list.Items[0].Namespace)
+		}
+	})
+}
+
+// Test that services of other owners and services without an owner outside
+// of the sink's namespace are not deleted when watching all namespaces.
+func TestK8SSink_namespaceRulesOwner(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Create the services of another sink, of an earlier version and of
+	// this sink in the sink's namespace
+	managed := map[string]string{LabelManagedBy: LabelManagedByValue}
+	other := map[string]string{LabelManagedBy: LabelManagedByValue, LabelOwner: "dc2"}
+	existing := []*apiv1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "team-a", Labels: other}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "team-a", Labels: managed}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: metav1.NamespaceDefault, Labels: managed}},
+	}
+	for _, svc := range existing {
+		_, err := client.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(err)
+	}
+
+	// Start the controller
+	sink := &K8SSink{
+		Client:           client,
+		Log:              hclog.Default(),
+		Owner:            "dc1",
+		NamespaceMetaKey: "k8s-namespace",
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{
+		"web": {DNSName: "web.service.local.", Name: "web", Meta: map[string]string{"k8s-namespace": "team-a"}},
+	})
+
+	// Verify the service is registered with the owner and that only the
+	// service without an owner in the sink's namespace is removed
+	retry.Run(t, func(r *retry.R) {
+		_, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("old", metav1.GetOptions{})
+		if err == nil {
+			r.Fatal("service should be deleted")
+		}
+	})
+
+	actual, err := client.CoreV1().Services("team-a").Get("web", metav1.GetOptions{})
+	require.NoError(err)
+	require.Equal("dc1", actual.Labels[LabelOwner])
+	for _, name := range []string{"other", "legacy"} {
+		_, err := client.CoreV1().Services("team-a").Get(name, metav1.GetOptions{})
+		require.NoError(err)
+	}
+}
+
+func TestK8SSink_translateNames(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	recorder := record.NewFakeRecorder(10)
+	sink := &K8SSink{
+		Client:        client,
+		Log:           hclog.Default(),
+		EventRecorder: recorder,
+		EventObject: &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "sync-catalog",
+			Namespace: metav1.NamespaceDefault,
+		}},
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set the services
+	sink.SetServices(map[string]Service{
+		"web-api": {DNSName: "web-api.service.local.", Name: "web-api"},
+		"web_api": {DNSName: "web_api.service.local.", Name: "web_api"},
+		"Web.API": {DNSName: "Web.API.service.local.", Name: "Web.API"},
+		"db_main": {DNSName: "db_main.service.local.", Name: "db_main"},
+		"_123":    {DNSName: "_123.service.local.", Name: "_123"},
+		"__":      {DNSName: "__.service.local.", Name: "__"},
+	})
+
+	// Verify the services are registered with translated names
+	expected := map[string]string{
+		"web-api":                               "web-api",
+		hashedServiceName("web-api", "web_api"): "web_api",
+		hashedServiceName("web-api", "Web.API"): "Web.API",
+		"db-main":                               "db_main",
+		"svc-123":                               "_123",
+	}
+	retry.Run(t, func(r *retry.R) {
+		list, err := client.CoreV1().Services(metav1.NamespaceDefault).List(metav1.ListOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(list.Items) != len(expected) {
+			r.Fatalf("bad: %#v", list.Items)
+		}
+		for _, svc := range list.Items {
+			if svc.Annotations[AnnotationConsulService] != expected[svc.Name] {
+				r.Fatalf("bad: %s: %#v", svc.Name, svc.Annotations)
+			}
+		}
+	})
+
+	// Names that can't be translated are reported
+	select {
+	case event := <-recorder.Events:
+		require.Contains(event, "Warning ServiceSkipped")
+		require.Contains(event, "__")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event recorded")
+	}
+}
+
+func TestK8SSink_adopt(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Adopt    bool
+		Expected string
+	}{
+		{"not adopted", false, "example.com."},
+		{"adopted", true, "web.service.local."},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+			client := fake.NewSimpleClientset()
+
+			// Create the existing service
+			_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "web",
+					Labels: map[string]string{"consul": "true"},
+				},
+
+				Spec: apiv1.ServiceSpec{
+					Type:         apiv1.ServiceTypeExternalName,
+					ExternalName: "example.com.",
+				},
+			})
+			require.NoError(err)
+
+			// Start the controller
+			sink := &K8SSink{
+				Client:        client,
+				Log:           hclog.Default(),
+				AdoptServices: tt.Adopt,
+			}
+			closer := controller.TestControllerRun(sink)
+			defer closer()
+
+			// Set a service
+			sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+
+			// Wait for the sync to run
+			time.Sleep(2 * K8SQuietPeriod)
+
+			actual, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+			require.NoError(err)
+			require.Equal(tt.Expected, actual.Spec.ExternalName)
+			require.Equal(tt.Adopt, actual.Labels[LabelManagedBy] == LabelManagedByValue)
+		})
+	}
+}
+
+// Test that a service is no longer updated or deleted once it is no
+// longer managed by the sink.
+func TestK8SSink_unmanaged(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink, closer := testSink(t, client)
+	defer closer()
+
+	// Set a service and wait for it to be created
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+	var service *apiv1.Service
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		service, err = client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+	})
+
+	// Remove the managed-by label
+	delete(service.Labels, LabelManagedBy)
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Update(service)
+	require.NoError(err)
+	time.Sleep(2 * K8SQuietPeriod)
+
+	// Change the service and wait for the sync to run
+	sink.SetServices(map[string]Service{"web": {DNSName: "web2.service.local."}})
+	time.Sleep(2 * K8SQuietPeriod)
+
+	actual, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+	require.NoError(err)
+	require.Equal("web.service.local.", actual.Spec.ExternalName)
+
+	// Remove the service and wait for the sync to run
+	sink.SetServices(map[string]Service{})
+	time.Sleep(2 * K8SQuietPeriod)
+
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+	require.NoError(err)
+}
+
+// Test that services are created with endpoints if syncing endpoints.
+func TestK8SSink_createEndpoints(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Start the controller
+	sink := &K8SSink{
+		Client:        client,
+		Log:           hclog.Default(),
+		SyncEndpoints: true,
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service with its instances
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+	sink.SetEndpoints("web", []Endpoint{
+		{Address: "10.0.0.1", Port: 8080},
+		{Address: "10.0.0.2", Port: 8080},
+	})
+
+	// Verify the endpoints get created
+	var endpoints *apiv1.Endpoints
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		endpoints, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+	})
+
+	require.Len(endpoints.Subsets, 1)
+	subset := endpoints.Subsets[0]
+	require.Len(subset.Addresses, 2)
+	require.Equal("10.0.0.1", subset.Addresses[0].IP)
+	require.Equal("10.0.0.2", subset.Addresses[1].IP)
+	require.Len(subset.Ports, 1)
+	require.Equal(int32(8080), subset.Ports[0].Port)
+
+	// Verify the service is a ClusterIP service without a selector
+	service, err := client.CoreV1().Services(metav1.NamespaceDefault).Get("web", metav1.GetOptions{})
+	require.NoError(err)
+	require.Equal(apiv1.ServiceTypeClusterIP, service.Spec.Type)
+	require.Empty(service.Spec.Selector)
+	require.Len(service.Spec.Ports, 1)
+	require.Equal(int32(8080), service.Spec.Ports[0].Port)
+}
+
 // Test that a service isn't registered if it exists already.
 func TestK8SSink_createExists(t *testing.T) {
 	t.Parallel()
@@ -85,7 +553,7 @@ func TestK8SSink_createExists(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	retry.Run(t, func(r *retry.R) {
@@ -114,6 +582,82 @@ func TestK8SSink_createExists(t *testing.T) {
 	})
 }
 
+// Test that an event is recorded if a service exists already.
+func TestK8SSink_createExistsEvent(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+
+	// Create the existing service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "web",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type:         apiv1.ServiceTypeExternalName,
+			ExternalName: "example.com.",
+		},
+	})
+	require.NoError(err)
+
+	// Start the controller
+	recorder := record.NewFakeRecorder(10)
+	sink := &K8SSink{
+		Client:        client,
+		Log:           hclog.Default(),
+		EventRecorder: recorder,
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+
+	select {
+	case event := <-recorder.Events:
+		require.Contains(event, "Warning ServiceExists")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event recorded")
+	}
+}
+
+// Test that services that fail to be created are recorded as events on the
+// event object.
+func TestK8SSink_createFailedEvent(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "services", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+
+	// Start the controller
+	recorder := record.NewFakeRecorder(10)
+	sink := &K8SSink{
+		Client:        client,
+		Log:           hclog.Default(),
+		EventRecorder: recorder,
+		EventObject: &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "sync-catalog",
+			Namespace: metav1.NamespaceDefault,
+		}},
+	}
+	closer := controller.TestControllerRun(sink)
+	defer closer()
+
+	// Set a service
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
+
+	select {
+	case event := <-recorder.Events:
+		require.Contains(event, "Warning CreateFailed")
+		require.Contains(event, "default/web")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event recorded")
+	}
+}
+
 // Test that if the service is updated remotely, that we change it back.
 func TestK8SSink_updateReconcile(t *testing.T) {
 	t.Parallel()
@@ -125,7 +669,7 @@ func TestK8SSink_updateReconcile(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	var actual *apiv1.Service
@@ -189,7 +733,7 @@ func TestK8SSink_updateService(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	var actual *apiv1.Service
@@ -213,7 +757,7 @@ func TestK8SSink_updateService(t *testing.T) {
 	})
 
 	// Update a service
-	sink.SetServices(map[string]string{"web": "web2.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web2.service.local."}})
 
 	// Verify service gets fixed
 	retry.Run(t, func(r *retry.R) {
@@ -252,7 +796,7 @@ func TestK8SSink_deleteReconcileRemote(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	var actual *apiv1.Service
@@ -315,7 +859,7 @@ func TestK8SSink_deleteReconcileLocal(t *testing.T) {
 	defer closer()
 
 	// Set a service
-	sink.SetServices(map[string]string{"web": "web.service.local."})
+	sink.SetServices(map[string]Service{"web": {DNSName: "web.service.local."}})
 
 	// Verify service gets registered
 	retry.Run(t, func(r *retry.R) {
@@ -337,7 +881,7 @@ func TestK8SSink_deleteReconcileLocal(t *testing.T) {
 	})
 
 	// Clear
-	sink.SetServices(map[string]string{})
+	sink.SetServices(map[string]Service{})
 
 	// Verify services get cleared
 	retry.Run(t, func(r *retry.R) {
@@ -384,3 +928,36 @@ func testSink(t *testing.T, client kubernetes.Interface) (*K8SSink, func()) {
 	closer := controller.TestControllerRun(sink)
 	return sink, closer
 }
+
+func TestK8SServiceName(t *testing.T) {
+	long := "a-very-long-service-name-that-is-longer-than-kubernetes-allows-for-names"
+
+	cases := []struct {
+		Name     string
+		Expected string
+		OK       bool
+	}{
+		{"web", "web", true},
+		{"web-api", "web-api", true},
+		{"web_api", "web-api", true},
+		{"Web.API", "web-api", true},
+		{"1web", "svc-1web", true},
+		{"web-", "web", true},
+		{"_123", "svc-123", true},
+		{"__", "", false},
+		{"", "", false},
+		{long, hashedServiceName(long, long), true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			actual, ok := k8sServiceName(tt.Name)
+			require.Equal(tt.OK, ok)
+			require.Equal(tt.Expected, actual)
+			if ok {
+				require.Len(validation.IsDNS1035Label(actual), 0)
+			}
+		})
+	}
+}
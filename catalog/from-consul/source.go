@@ -3,9 +3,11 @@ package catalog
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	fromk8s "github.com/hashicorp/consul-k8s/catalog/from-k8s"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
 )
@@ -19,23 +21,259 @@ type Source struct {
 	Prefix       string       // Prefix is a prefix to prepend to services
 	Log          hclog.Logger // Logger
 	ConsulK8STag string       // The tag value for services registered
+
+	// RequireTags and ExcludeTags filter the services to sync by their
+	// tags. A service is only synced if it has all of the RequireTags and
+	// none of the ExcludeTags.
+	RequireTags []string
+	ExcludeTags []string
+
+	// NodeMeta limits the synced services to those with instances on nodes
+	// that have all of the given node meta.
+	NodeMeta map[string]string
+
+	// Filter is a Consul filter expression evaluated against the instances
+	// of each service, such as `ServiceMeta.team == "web"`. A service is only
+	// synced if at least one of its instances matches. This requires an extra
+	// request per service so tag or node meta filters should be preferred.
+	Filter string
+
+	// Datacenters are the Consul datacenters to sync services from, in
+	// order of preference. If a service exists in more than one of them,
+	// the first datacenter is used. If this is empty, the local datacenter
+	// of the agent is used.
+	Datacenters []string
+
+	// SyncEndpoints, if true, watches the healthy instances of every synced
+	// service and sends them to the Sink, which must be an EndpointsSink.
+	SyncEndpoints bool
+
+	// ServiceDetails, if true, sends the meta shared by all instances of
+	// every service and the port used by most of them to the Sink. This
+	// requires an extra request per service whenever the services change.
+	ServiceDetails bool
+}
+
+// sourceUpdate is the set of services for a single datacenter.
+type sourceUpdate struct {
+	Datacenter string
+	Services   map[string]Service // keyed by sink name
+}
+
+// endpointsWatcher is a running watcher of the instances of a service.
+type endpointsWatcher struct {
+	Datacenter string
+	Name       string
+	Cancel     context.CancelFunc
 }
 
 // Run is the long-running runloop for watching Consul services and
 // updating the Sink.
 func (s *Source) Run(ctx context.Context) {
+	dcs := s.Datacenters
+	if len(dcs) == 0 {
+		// The empty datacenter is the local datacenter of the agent.
+		dcs = []string{""}
+	}
+
+	// Start a watcher for every datacenter. Each watcher sends the full
+	// set of services of its datacenter whenever it changes.
+	updateCh := make(chan sourceUpdate)
+	for _, dc := range dcs {
+		go s.watchDatacenter(ctx, dc, updateCh)
+	}
+
+	var endpointsSink EndpointsSink
+	if s.SyncEndpoints {
+		var ok bool
+		endpointsSink, ok = s.Sink.(EndpointsSink)
+		if !ok {
+			s.Log.Error("sink doesn't support endpoints, not syncing endpoints")
+		}
+	}
+
+	// watchers are the running endpoints watchers keyed by sink name.
+	watchers := make(map[string]*endpointsWatcher)
+	defer func() {
+		for _, w := range watchers {
+			w.Cancel()
+		}
+	}()
+
+	current := make(map[string]sourceUpdate, len(dcs))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case update := <-updateCh:
+			current[update.Datacenter] = update
+		}
+
+		// Merge the services in reverse order of preference so that the
+		// most preferred datacenter wins if a service exists in many.
+		services := make(map[string]Service)
+		sources := make(map[string]*endpointsWatcher)
+		for i := len(dcs) - 1; i >= 0; i-- {
+			for k, v := range current[dcs[i]].Services {
+				services[k] = v
+				sources[k] = &endpointsWatcher{
+					Datacenter: v.Datacenter,
+					Name:       v.Name,
+				}
+			}
+		}
+		s.Log.Info("received services from Consul", "count", len(services))
+
+		s.Sink.SetServices(services)
+
+		if endpointsSink != nil {
+			s.updateEndpointsWatchers(ctx, endpointsSink, watchers, sources)
+		}
+	}
+}
+
+// updateEndpointsWatchers starts and stops the endpoints watchers so that
+// exactly the given services are watched.
+func (s *Source) updateEndpointsWatchers(
+	ctx context.Context,
+	sink EndpointsSink,
+	watchers map[string]*endpointsWatcher,
+	sources map[string]*endpointsWatcher,
+) {
+	for k, w := range watchers {
+		if src, ok := sources[k]; !ok || src.Datacenter != w.Datacenter || src.Name != w.Name {
+			w.Cancel()
+			delete(watchers, k)
+		}
+	}
+
+	for k, src := range sources {
+		if _, ok := watchers[k]; ok {
+			continue
+		}
+
+		watchCtx, cancelF := context.WithCancel(ctx)
+		src.Cancel = cancelF
+		watchers[k] = src
+		go s.watchEndpoints(watchCtx, sink, k, src.Datacenter, src.Name)
+	}
+}
+
+// watchEndpoints is a long-running task that holds blocking queries for
+// the healthy instances of the given service and updates the sink with
+// them whenever they change.
+func (s *Source) watchEndpoints(ctx context.Context, sink EndpointsSink, key, dc, name string) {
+	s.Log.Debug("starting endpoints watcher", "service-name", name, "datacenter", dc)
+	defer s.Log.Debug("stopping endpoints watcher", "service-name", name, "datacenter", dc)
+
 	opts := (&api.QueryOptions{
 		AllowStale: true,
 		WaitIndex:  1,
 		WaitTime:   1 * time.Minute,
+		Datacenter: dc,
 	}).WithContext(ctx)
 	for {
-		// Get all services with tags.
-		var serviceMap map[string][]string
+		var entries []*api.ServiceEntry
+		var meta *api.QueryMeta
+		err := backoff.Retry(func() error {
+			var err error
+			entries, meta, err = s.Client.Health().Service(name, "", true, opts)
+			return err
+		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+
+		// If the context is ended, then we end
+		if ctx.Err() != nil {
+			return
+		}
+
+		// If there was an error, handle that
+		if err != nil {
+			s.Log.Warn("error querying service health, will retry",
+				"service-name", name,
+				"datacenter", dc,
+				"err", err)
+			continue
+		}
+
+		// Update our blocking index
+		opts.WaitIndex = meta.LastIndex
+
+		endpoints := make([]Endpoint, 0, len(entries))
+		for _, entry := range entries {
+			// The service address defaults to the node address.
+			addr := entry.Service.Address
+			if addr == "" {
+				addr = entry.Node.Address
+			}
+
+			endpoints = append(endpoints, Endpoint{
+				Address: addr,
+				Port:    entry.Service.Port,
+			})
+		}
+
+		// Sort so the sink can easily detect changes.
+		sort.Slice(endpoints, func(i, j int) bool {
+			if endpoints[i].Address != endpoints[j].Address {
+				return endpoints[i].Address < endpoints[j].Address
+			}
+			return endpoints[i].Port < endpoints[j].Port
+		})
+
+		sink.SetEndpoints(key, endpoints)
+	}
+}
+
+// watchDatacenter is a long-running task started by Run that holds
+// blocking queries for the services in the given datacenter and sends the
+// services to sync on updateCh whenever they change.
+func (s *Source) watchDatacenter(ctx context.Context, dc string, updateCh chan<- sourceUpdate) {
+	// The services record the datacenter they are from, so look up the
+	// name of the local datacenter.
+	dcName := dc
+	for dcName == "" {
+		err := backoff.Retry(func() error {
+			var err error
+			dcName, err = s.localDatacenter()
+			return err
+		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+
+		// If the context is ended, then we end
+		if ctx.Err() != nil {
+			return
+		}
+
+		// If there was an error, handle that
+		if err != nil {
+			s.Log.Warn("error querying local datacenter, will retry", "err", err)
+		}
+	}
+
+	opts := (&api.QueryOptions{
+		AllowStale: true,
+		WaitIndex:  1,
+		WaitTime:   1 * time.Minute,
+		Datacenter: dc,
+		NodeMeta:   s.NodeMeta,
+	}).WithContext(ctx)
+	for {
+		// Get all services with tags, along with the services that have
+		// instances synced from K8S.
+		var serviceMap, k8sServiceMap map[string][]string
 		var meta *api.QueryMeta
 		err := backoff.Retry(func() error {
 			var err error
 			serviceMap, meta, err = s.Client.Catalog().Services(opts)
+			if err != nil {
+				return err
+			}
+
+			k8sServiceMap, _, err = s.Client.Catalog().Services((&api.QueryOptions{
+				AllowStale: true,
+				Datacenter: dc,
+				NodeMeta:   map[string]string{fromk8s.ConsulSourceKey: fromk8s.ConsulSourceValue},
+			}).WithContext(ctx))
 			return err
 		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 
@@ -46,7 +284,9 @@ func (s *Source) Run(ctx context.Context) {
 
 		// If there was an error, handle that
 		if err != nil {
-			s.Log.Warn("error querying services, will retry", "err", err)
+			s.Log.Warn("error querying services, will retry",
+				"datacenter", dc,
+				"err", err)
 			continue
 		}
 
@@ -54,27 +294,174 @@ func (s *Source) Run(ctx context.Context) {
 		opts.WaitIndex = meta.LastIndex
 
 		// Setup the services
-		services := make(map[string]string, len(serviceMap))
+		services := make(map[string]Service, len(serviceMap))
 		for name, tags := range serviceMap {
 			// We ignore services that are synced from k8s so we can avoid
 			// circular syncing. Realistically this shouldn't happen since
 			// we won't register services that already exist but we double
 			// check here.
-			k8s := false
-			for _, t := range tags {
-				if t == s.ConsulK8STag {
-					k8s = true
-					break
+			if containsString(tags, s.ConsulK8STag) {
+				continue
+			}
+
+			// The tag can be changed or removed, so services are also
+			// ignored if they have any instances synced from K8S.
+			if _, ok := k8sServiceMap[name]; ok {
+				s.Log.Debug("ignoring service synced from K8S",
+					"datacenter", dc,
+					"service-name", name)
+				continue
+			}
+
+			if !s.tagsAllowed(tags) {
+				continue
+			}
+
+			svc := Service{
+				DNSName:    s.dnsName(dc, name),
+				Name:       name,
+				Datacenter: dcName,
+				Tags:       tags,
+			}
+
+			if s.Filter != "" || s.ServiceDetails {
+				instances, err := s.instances(ctx, dc, name)
+				if err != nil {
+					s.Log.Warn("error querying service instances, not syncing",
+						"datacenter", dc,
+						"service-name", name,
+						"err", err)
+					continue
+				}
+
+				// The service is only synced if an instance matches
+				if len(instances) == 0 {
+					continue
+				}
+
+				if s.ServiceDetails {
+					svc.Meta = commonMeta(instances)
+					svc.Port = instancesPort(instances)
 				}
 			}
 
-			if !k8s {
-				services[s.Prefix+name] = fmt.Sprintf("%s.service.%s", name, s.Domain)
+			services[s.Prefix+name] = svc
+		}
+
+		select {
+		case updateCh <- sourceUpdate{Datacenter: dc, Services: services}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// localDatacenter returns the name of the datacenter of the agent.
+func (s *Source) localDatacenter() (string, error) {
+	self, err := s.Client.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+
+	dc, ok := self["Config"]["Datacenter"].(string)
+	if !ok {
+		return "", fmt.Errorf("agent didn't return its datacenter")
+	}
+
+	return dc, nil
+}
+
+// tagsAllowed returns true if the given service tags pass the required
+// and excluded tag filters.
+func (s *Source) tagsAllowed(tags []string) bool {
+	for _, t := range s.RequireTags {
+		if !containsString(tags, t) {
+			return false
+		}
+	}
+
+	for _, t := range s.ExcludeTags {
+		if containsString(tags, t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// instances returns the instances of the service with the given name that
+// match the node meta and filter expression. Instances synced from K8S are
+// never returned.
+func (s *Source) instances(ctx context.Context, dc, name string) ([]*api.CatalogService, error) {
+	services, _, err := s.Client.Catalog().Service(name, "", (&api.QueryOptions{
+		AllowStale: true,
+		Datacenter: dc,
+		NodeMeta:   s.NodeMeta,
+		Filter:     s.Filter,
+	}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	result := services[:0]
+	for _, svc := range services {
+		if svc.ServiceMeta[fromk8s.ConsulSourceKey] != fromk8s.ConsulSourceValue {
+			result = append(result, svc)
+		}
+	}
+
+	return result, nil
+}
+
+// commonMeta returns the service meta that all the given instances have.
+func commonMeta(instances []*api.CatalogService) map[string]string {
+	if len(instances) == 0 {
+		return nil
+	}
+
+	meta := make(map[string]string)
+	for k, v := range instances[0].ServiceMeta {
+		meta[k] = v
+	}
+	for _, instance := range instances[1:] {
+		for k, v := range meta {
+			if instance.ServiceMeta[k] != v {
+				delete(meta, k)
 			}
 		}
-		s.Log.Info("received services from Consul", "count", len(services))
+	}
 
-		// Lock so we can modify the
-		s.Sink.SetServices(services)
+	return meta
+}
+
+// instancesPort returns the port used by most of the given instances, or
+// zero if none of them have a port.
+func instancesPort(instances []*api.CatalogService) int {
+	eps := make([]Endpoint, 0, len(instances))
+	for _, instance := range instances {
+		eps = append(eps, Endpoint{Port: instance.ServicePort})
 	}
+
+	return commonPort(eps)
+}
+
+// dnsName returns the Consul DNS name of the service with the given name
+// in the given datacenter. The local datacenter is used if dc is empty.
+func (s *Source) dnsName(dc, name string) string {
+	if dc == "" {
+		return fmt.Sprintf("%s.service.%s", name, s.Domain)
+	}
+
+	return fmt.Sprintf("%s.service.%s.%s", name, dc, s.Domain)
+}
+
+// containsString returns true if the string is in the given slice.
+func containsString(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
 }
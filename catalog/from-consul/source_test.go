@@ -4,14 +4,19 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	fromk8s "github.com/hashicorp/consul-k8s/catalog/from-k8s"
+	"github.com/hashicorp/consul-k8s/helper/controller"
 	"github.com/hashicorp/consul/agent"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil/retry"
 	"github.com/hashicorp/consul/testrpc"
 	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 // Test that the source works with services registered before hand.
@@ -36,10 +41,12 @@ func TestSource_initServices(t *testing.T) {
 	defer closer()
 
 	var actual map[string]string
+	var raw map[string]Service
 	retry.Run(t, func(r *retry.R) {
 		sink.Lock()
 		defer sink.Unlock()
 		actual = sink.Services
+		raw = sink.Raw
 		if len(actual) == 0 {
 			r.Fatal("services not found")
 		}
@@ -51,6 +58,10 @@ func TestSource_initServices(t *testing.T) {
 		"svcB":   "svcB.service.test",
 	}
 	require.Equal(expected, actual)
+
+	// The services record their Consul name and datacenter
+	require.Equal("svcA", raw["svcA"].Name)
+	require.Equal("dc1", raw["svcA"].Datacenter)
 }
 
 // Test that we can specify a prefix to prepend to all destination services.
@@ -131,6 +142,129 @@ func TestSource_ignoreK8S(t *testing.T) {
 	require.Equal(expected, actual)
 }
 
+// Test that services are filtered by required and excluded tags.
+func TestSource_tags(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Create services before the source is running
+	_, err := client.Catalog().Register(testRegistration("hostA", "svcA", []string{"public"}), nil)
+	require.NoError(err)
+	_, err = client.Catalog().Register(testRegistration("hostA", "svcB", []string{"public", "canary"}), nil)
+	require.NoError(err)
+	_, err = client.Catalog().Register(testRegistration("hostA", "svcC", nil), nil)
+	require.NoError(err)
+
+	_, sink, closer := testSourceConfig(t, client, func(s *Source) {
+		s.RequireTags = []string{"public"}
+		s.ExcludeTags = []string{"canary"}
+	})
+	defer closer()
+
+	var actual map[string]string
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		actual = sink.Services
+		if len(actual) == 0 {
+			r.Fatal("services not found")
+		}
+	})
+
+	expected := map[string]string{
+		"svcA": "svcA.service.test",
+	}
+	require.Equal(expected, actual)
+}
+
+// Test that services are filtered by node meta and filter expressions.
+func TestSource_filter(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Create services before the source is running
+	reg := testRegistration("hostA", "svcA", nil)
+	reg.NodeMeta = map[string]string{"env": "prod"}
+	reg.Service.Meta = map[string]string{"team": "web"}
+	_, err := client.Catalog().Register(reg, nil)
+	require.NoError(err)
+	reg = testRegistration("hostA", "svcB", nil)
+	reg.NodeMeta = map[string]string{"env": "prod"}
+	_, err = client.Catalog().Register(reg, nil)
+	require.NoError(err)
+	reg = testRegistration("hostB", "svcC", nil)
+	reg.Service.Meta = map[string]string{"team": "web"}
+	_, err = client.Catalog().Register(reg, nil)
+	require.NoError(err)
+
+	_, sink, closer := testSourceConfig(t, client, func(s *Source) {
+		s.NodeMeta = map[string]string{"env": "prod"}
+		s.Filter = `ServiceMeta.team == "web"`
+	})
+	defer closer()
+
+	var actual map[string]string
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		actual = sink.Services
+		if len(actual) == 0 {
+			r.Fatal("services not found")
+		}
+	})
+
+	expected := map[string]string{
+		"svcA": "svcA.service.test",
+	}
+	require.Equal(expected, actual)
+}
+
+// Test that services from an explicit datacenter use the datacenter DNS name.
+func TestSource_datacenters(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Create services before the source is running
+	_, err := client.Catalog().Register(testRegistration("hostA", "svcA", nil), nil)
+	require.NoError(err)
+
+	_, sink, closer := testSourceConfig(t, client, func(s *Source) {
+		s.Datacenters = []string{"dc1"}
+	})
+	defer closer()
+
+	var actual map[string]string
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		actual = sink.Services
+		if len(actual) != 2 {
+			r.Fatal("services not found")
+		}
+	})
+
+	expected := map[string]string{
+		"consul": "consul.service.dc1.test",
+		"svcA":   "svcA.service.dc1.test",
+	}
+	require.Equal(expected, actual)
+}
+
 // Test that the source deletes services properly.
 func TestSource_deleteService(t *testing.T) {
 	t.Parallel()
@@ -233,6 +367,199 @@ func TestSource_deleteServiceInstance(t *testing.T) {
 	})
 }
 
+// Test that the healthy instances of services are sent to the sink.
+func TestSource_endpoints(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Create services before the source is running
+	regA := testRegistration("hostA", "svcA", nil)
+	regA.Service.Port = 8080
+	_, err := client.Catalog().Register(regA, nil)
+	require.NoError(err)
+	regB := testRegistration("hostB", "svcA", nil)
+	regB.Address = "127.0.0.2"
+	regB.Service.Port = 8080
+	_, err = client.Catalog().Register(regB, nil)
+	require.NoError(err)
+
+	_, sink, closer := testSourceConfig(t, client, func(s *Source) {
+		s.SyncEndpoints = true
+	})
+	defer closer()
+
+	var actual []Endpoint
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		actual = sink.Endpoints["svcA"]
+		if len(actual) != 2 {
+			r.Fatal("endpoints not found")
+		}
+	})
+
+	expected := []Endpoint{
+		{Address: "127.0.0.1", Port: 8080},
+		{Address: "127.0.0.2", Port: 8080},
+	}
+	require.Equal(expected, actual)
+}
+
+// Test that the details of services are sent to the sink.
+func TestSource_serviceDetails(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Create services before the source is running
+	regA := testRegistration("hostA", "svcA", []string{"a"})
+	regA.Service.Port = 8080
+	regA.Service.Meta = map[string]string{"team": "web", "version": "1"}
+	_, err := client.Catalog().Register(regA, nil)
+	require.NoError(err)
+	regB := testRegistration("hostB", "svcA", []string{"b"})
+	regB.Service.Port = 8080
+	regB.Service.Meta = map[string]string{"team": "web", "version": "2"}
+	_, err = client.Catalog().Register(regB, nil)
+	require.NoError(err)
+
+	_, sink, closer := testSourceConfig(t, client, func(s *Source) {
+		s.ServiceDetails = true
+	})
+	defer closer()
+
+	var actual Service
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		var ok bool
+		actual, ok = sink.Raw["svcA"]
+		if !ok {
+			r.Fatal("service not found")
+		}
+	})
+
+	require.ElementsMatch([]string{"a", "b"}, actual.Tags)
+	require.Equal(map[string]string{"team": "web"}, actual.Meta)
+	require.Equal(8080, actual.Port)
+}
+
+// Test that services aren't synced back and forth between K8S and Consul
+// when both directions of the sync are running, even if the K8S tag of
+// the directions doesn't match.
+func TestSource_bidirectional(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+	k8s := fake.NewSimpleClientset()
+
+	// Start the K8S to Consul sync
+	syncer := &fromk8s.ConsulSyncer{
+		Client:            client,
+		Log:               hclog.Default(),
+		SyncPeriod:        200 * time.Millisecond,
+		ServicePollPeriod: 50 * time.Millisecond,
+		Namespace:         metav1.NamespaceDefault,
+		ConsulK8STag:      fromk8s.TestConsulK8STag,
+	}
+	ctx, cancelF := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		syncer.Run(ctx)
+	}()
+	defer func() {
+		cancelF()
+		<-doneCh
+	}()
+
+	closer := controller.TestControllerRun(&fromk8s.ServiceResource{
+		Log:                 hclog.Default(),
+		Client:              k8s,
+		Syncer:              syncer,
+		ConsulK8STag:        fromk8s.TestConsulK8STag,
+		ConsulServicePrefix: "k8s-",
+		ClusterIPSync:       true,
+	})
+	defer closer()
+
+	// Start the Consul to K8S sync with a different K8S tag
+	sink := &K8SSink{
+		Client: k8s,
+		Log:    hclog.Default(),
+	}
+	closer = controller.TestControllerRun(sink)
+	defer closer()
+
+	_, _, closer = testSourceConfig(t, client, func(s *Source) {
+		s.Sink = sink
+		s.Prefix = "consul-"
+		s.ConsulK8STag = "other"
+	})
+	defer closer()
+
+	// Create a service in each
+	_, err := k8s.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeLoadBalancer,
+		},
+		Status: apiv1.ServiceStatus{
+			LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{
+					apiv1.LoadBalancerIngress{IP: "1.2.3.4"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+	_, err = client.Catalog().Register(testRegistration("hostA", "db", nil), nil)
+	require.NoError(err)
+
+	// Verify the services are synced in both directions
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Services(nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if _, ok := services["k8s-web"]; !ok {
+			r.Fatal("service not synced to Consul")
+		}
+
+		_, err = k8s.CoreV1().Services(metav1.NamespaceDefault).Get("consul-db", metav1.GetOptions{})
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+	})
+
+	// Give the syncs time to loop the services
+	time.Sleep(2 * K8SQuietPeriod)
+
+	// Verify the services weren't synced back
+	services, _, err := client.Catalog().Services(nil)
+	require.NoError(err)
+	require.NotContains(services, "k8s-consul-db")
+
+	list, err := k8s.CoreV1().Services(metav1.NamespaceDefault).List(metav1.ListOptions{})
+	require.NoError(err)
+	for _, svc := range list.Items {
+		require.NotEqual("consul-k8s-web", svc.Name)
+	}
+}
+
 // testRegistration creates a Consul test registration.
 func testRegistration(node, service string, tags []string) *api.CatalogRegistration {
 	return &api.CatalogRegistration{
@@ -247,6 +574,12 @@ func testRegistration(node, service string, tags []string) *api.CatalogRegistrat
 
 // testSource creates a Source and Sink for testing.
 func testSource(t *testing.T, client *api.Client) (*Source, *TestSink, func()) {
+	return testSourceConfig(t, client, func(*Source) {})
+}
+
+// testSourceConfig creates a Source and Sink for testing, calling the
+// given function to configure the Source before it is started.
+func testSourceConfig(t *testing.T, client *api.Client, f func(*Source)) (*Source, *TestSink, func()) {
 	sink := &TestSink{}
 	s := &Source{
 		Client:       client,
@@ -255,6 +588,7 @@ func testSource(t *testing.T, client *api.Client) (*Source, *TestSink, func()) {
 		Log:          hclog.Default(),
 		ConsulK8STag: fromk8s.TestConsulK8STag,
 	}
+	f(s)
 
 	ctx, cancelF := context.WithCancel(context.Background())
 	doneCh := make(chan struct{})
@@ -8,11 +8,26 @@ import (
 // Reading/writing the services should be done only while the lock is held.
 type TestSink struct {
 	sync.Mutex
-	Services map[string]string
+	Services  map[string]string // service name to DNS name
+	Raw       map[string]Service
+	Endpoints map[string][]Endpoint
 }
 
-func (s *TestSink) SetServices(raw map[string]string) {
+func (s *TestSink) SetServices(raw map[string]Service) {
 	s.Lock()
 	defer s.Unlock()
-	s.Services = raw
+	s.Raw = raw
+	s.Services = make(map[string]string, len(raw))
+	for k, v := range raw {
+		s.Services[k] = v.DNSName
+	}
+}
+
+func (s *TestSink) SetEndpoints(name string, endpoints []Endpoint) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Endpoints == nil {
+		s.Endpoints = make(map[string][]Endpoint)
+	}
+	s.Endpoints[name] = endpoints
 }
@@ -6,6 +6,11 @@ const (
 	// the default based on the syncer configuration is chosen.
 	annotationServiceSync = "consul.hashicorp.com/service-sync"
 
+	// annotationIngressSync is the key of the annotation that determines
+	// whether to sync the Ingress resource or not. Unlike services, ingresses
+	// are only synced if this is set to a truthy value.
+	annotationIngressSync = "consul.hashicorp.com/ingress-sync"
+
 	// annotationServiceName is set to override the name of the service
 	// registered. By default this will be the name of the Service resource.
 	annotationServiceName = "consul.hashicorp.com/service-name"
@@ -15,6 +20,11 @@ const (
 	// service or an integer value.
 	annotationServicePort = "consul.hashicorp.com/service-port"
 
+	// annotationServiceMultiPort is set to a truthy value to register each
+	// port of the Service resource as a separate service named
+	// "<service>-<port name>". This ignores annotationServicePort.
+	annotationServiceMultiPort = "consul.hashicorp.com/service-multi-port"
+
 	// annotationServiceTags specifies the tags for the registered service
 	// instance. Multiple tags should be comma separated. Whitespace around
 	// the tags is automatically trimmed.
@@ -23,4 +33,32 @@ const (
 	// annotationServiceMetaPrefix is the prefix for setting meta key/value
 	// for a service. The remainder of the key is the meta key.
 	annotationServiceMetaPrefix = "consul.hashicorp.com/service-meta-"
+
+	// annotationServiceWeightPassing and annotationServiceWeightWarning set
+	// the weights of every registered service instance when its checks are
+	// passing or warning. The passing weight can be "endpoints" to use the
+	// number of ready endpoints of the service, so instances such as load
+	// balancers get traffic in proportion to the pods behind them. Instances
+	// registered for each endpoint, such as those of ClusterIP services,
+	// get a weight of 1 since they stand for a single endpoint. The warning
+	// weight defaults to 1.
+	annotationServiceWeightPassing = "consul.hashicorp.com/service-weight-passing"
+	annotationServiceWeightWarning = "consul.hashicorp.com/service-weight-warning"
+
+	// weightEndpoints is the value of annotationServiceWeightPassing that
+	// sets the weight to the number of ready endpoints.
+	weightEndpoints = "endpoints"
+
+	// annotationServiceCheckHTTP and annotationServiceCheckTCP add an HTTP
+	// or TCP check to every registered service instance. The value is the
+	// URL or address to check, in which "${address}" and "${port}" are
+	// replaced with the address and port of each instance, such as
+	// "http://${address}:${port}/health". These checks are only run if
+	// consul-esm is running and monitors the nodes of the instances.
+	annotationServiceCheckHTTP = "consul.hashicorp.com/service-check-http"
+	annotationServiceCheckTCP  = "consul.hashicorp.com/service-check-tcp"
+
+	// annotationServiceCheckInterval is the interval of the checks, such as
+	// "30s". This defaults to 10 seconds.
+	annotationServiceCheckInterval = "consul.hashicorp.com/service-check-interval"
 )
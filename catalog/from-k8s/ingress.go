@@ -0,0 +1,253 @@
+package catalog
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ConsulK8SIngress is the key used in the meta to record the Kubernetes
+	// ingress a registration was generated from, in the form of
+	// "namespace/name".
+	ConsulK8SIngress = "external-k8s-ingress"
+
+	// ConsulK8SIngressHost and ConsulK8SIngressPaths are the keys used in
+	// the meta to record the host of the ingress rule a registration was
+	// generated from and its paths, separated by commas.
+	ConsulK8SIngressHost  = "external-k8s-ingress-host"
+	ConsulK8SIngressPaths = "external-k8s-ingress-paths"
+
+	// ingressKeyPrefix is the prefix of the keys of the registrations
+	// generated from ingresses so they don't collide with the keys of
+	// services with the same name.
+	ingressKeyPrefix = "ingress/"
+)
+
+// serviceIngressResource implements controller.Resource and starts a
+// background watcher on ingresses that is used by the ServiceResource to
+// register a service for every host of the ingresses that are enabled.
+type serviceIngressResource struct {
+	Service *ServiceResource
+}
+
+func (t *serviceIngressResource) Informer() cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.Service.Client.ExtensionsV1beta1().
+					Ingresses(t.Service.namespace()).
+					List(options)
+			},
+
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.Service.Client.ExtensionsV1beta1().
+					Ingresses(t.Service.namespace()).
+					Watch(options)
+			},
+		},
+		&extv1beta1.Ingress{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+func (t *serviceIngressResource) Upsert(key string, raw interface{}) error {
+	svc := t.Service
+	ingress, ok := raw.(*extv1beta1.Ingress)
+	if !ok {
+		svc.Log.Warn("upsert got invalid type", "raw", raw)
+		return nil
+	}
+
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	// If syncing was disabled, then remove any registrations of the
+	// ingress that were generated before.
+	if !t.shouldSync(ingress) {
+		svc.Log.Debug("syncing disabled for ingress, ignoring", "key", key)
+		if _, ok := svc.consulMap[ingressKeyPrefix+key]; ok {
+			delete(svc.consulMap, ingressKeyPrefix+key)
+			svc.sync()
+		}
+		return nil
+	}
+
+	// Update the registration and trigger a sync
+	t.generateRegistrations(key, ingress)
+	svc.sync()
+	svc.Log.Info("upsert ingress", "key", key)
+	return nil
+}
+
+func (t *serviceIngressResource) Delete(key string) error {
+	t.Service.serviceLock.Lock()
+	defer t.Service.serviceLock.Unlock()
+
+	if _, ok := t.Service.consulMap[ingressKeyPrefix+key]; ok {
+		delete(t.Service.consulMap, ingressKeyPrefix+key)
+		t.Service.sync()
+	}
+
+	t.Service.Log.Info("delete ingress", "key", key)
+	return nil
+}
+
+// shouldSync returns true if the given ingress should be synced. Unlike
+// services, ingresses are only synced if they are explicitly enabled.
+func (t *serviceIngressResource) shouldSync(ingress *extv1beta1.Ingress) bool {
+	svc := t.Service
+	if svc.namespace() == metav1.NamespaceAll &&
+		ingress.Namespace == metav1.NamespaceSystem &&
+		!containsString(svc.AllowK8SNamespaces, metav1.NamespaceSystem) {
+		return false
+	}
+
+	if !svc.namespaceAllowed(ingress.Namespace) {
+		return false
+	}
+
+	raw, ok := ingress.Annotations[annotationIngressSync]
+	if !ok {
+		return false
+	}
+
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		svc.Log.Warn("error parsing ingress-sync annotation",
+			"ingress", ingress.Namespace+"/"+ingress.Name,
+			"err", err)
+		return false
+	}
+
+	return v
+}
+
+// generateRegistrations generates the registrations for the given ingress.
+// A service is registered for every host of the rules of the ingress, with
+// an instance for each load balancer address of the ingress.
+//
+// Precondition: lock must be held
+func (t *serviceIngressResource) generateRegistrations(key string, ingress *extv1beta1.Ingress) {
+	svc := t.Service
+	if svc.consulMap == nil {
+		svc.consulMap = make(map[string][]*consulapi.CatalogRegistration)
+	}
+	delete(svc.consulMap, ingressKeyPrefix+key)
+
+	// Hosts that are in the TLS section of the ingress are served on the
+	// HTTPS port.
+	tls := make(map[string]struct{})
+	for _, t := range ingress.Spec.TLS {
+		for _, host := range t.Hosts {
+			tls[host] = struct{}{}
+		}
+	}
+
+	// Collect the paths of every host since a host can be in more than
+	// one rule. Wildcard hosts can't be registered.
+	var hosts []string
+	paths := make(map[string]map[string]struct{})
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+			continue
+		}
+
+		if _, ok := paths[rule.Host]; !ok {
+			hosts = append(hosts, rule.Host)
+			paths[rule.Host] = make(map[string]struct{})
+		}
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			path := p.Path
+			if path == "" {
+				path = "/"
+			}
+			paths[rule.Host][path] = struct{}{}
+		}
+	}
+
+	var addrs []string
+	seen := make(map[string]struct{})
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		addr := lb.IP
+		if addr == "" {
+			addr = lb.Hostname
+		}
+		if addr == "" {
+			continue
+		}
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	baseNode := svc.baseNode()
+	for _, host := range hosts {
+		hostPaths := make([]string, 0, len(paths[host]))
+		for p := range paths[host] {
+			hostPaths = append(hostPaths, p)
+		}
+		sort.Strings(hostPaths)
+
+		baseService := consulapi.AgentService{
+			Service: svc.prefixServiceName(strings.Replace(host, ".", "-", -1)),
+			Tags:    []string{svc.ConsulK8STag},
+			Port:    80,
+			Meta: map[string]string{
+				ConsulSourceKey:       ConsulSourceValue,
+				ConsulK8SNS:           svc.namespace(),
+				ConsulK8SIngress:      key,
+				ConsulK8SIngressHost:  host,
+				ConsulK8SIngressPaths: strings.Join(hostPaths, ","),
+			},
+		}
+		if _, ok := tls[host]; ok {
+			baseService.Port = 443
+		}
+		if svc.ClusterName != "" {
+			baseService.Meta[ConsulK8SCluster] = svc.ClusterName
+		}
+
+		// Parse any additional tags and meta
+		if tags, ok := ingress.Annotations[annotationServiceTags]; ok {
+			for _, t := range strings.Split(tags, ",") {
+				baseService.Tags = append(baseService.Tags, strings.TrimSpace(t))
+			}
+		}
+		for k, v := range ingress.Annotations {
+			if strings.HasPrefix(k, annotationServiceMetaPrefix) {
+				k = strings.TrimPrefix(k, annotationServiceMetaPrefix)
+				baseService.Meta[k] = v
+			}
+		}
+
+		// The ID includes the ingress since ingresses can share the same
+		// host and load balancer address.
+		for _, addr := range addrs {
+			r := baseNode
+			rs := baseService
+			r.Service = &rs
+			r.Service.ID = serviceID(r.Service.Service, key+"/"+addr)
+			r.Service.Address = addr
+			svc.consulMap[ingressKeyPrefix+key] = append(svc.consulMap[ingressKeyPrefix+key], &r)
+		}
+	}
+
+	svc.Log.Debug("generated ingress registrations",
+		"key", key,
+		"hosts", len(hosts),
+		"instances", len(svc.consulMap[ingressKeyPrefix+key]))
+}
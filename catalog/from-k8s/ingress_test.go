@@ -0,0 +1,236 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-k8s/helper/controller"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Test that an enabled ingress registers a service for every host.
+func TestServiceIngressResource_hosts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ConsulK8STag:  TestConsulK8STag,
+		SyncIngresses: true,
+	})
+	defer closer()
+
+	// Insert the ingress
+	ingress := testIngress("foo")
+	ingress.Spec.TLS = []extv1beta1.IngressTLS{
+		extv1beta1.IngressTLS{Hosts: []string{"api.example.com"}},
+	}
+	ingress.Spec.Rules = append(ingress.Spec.Rules, testIngressRule("api.example.com", "/v2"))
+	_, err := client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Create(ingress)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+
+	services := make(map[string]*consulServiceInfo)
+	for _, r := range actual {
+		services[r.Service.Service] = &consulServiceInfo{
+			Address: r.Service.Address,
+			Port:    r.Service.Port,
+			Meta:    r.Service.Meta,
+		}
+	}
+
+	require.Contains(services, "web-example-com")
+	require.Equal("1.2.3.4", services["web-example-com"].Address)
+	require.Equal(80, services["web-example-com"].Port)
+	require.Equal("web.example.com", services["web-example-com"].Meta[ConsulK8SIngressHost])
+	require.Equal("/", services["web-example-com"].Meta[ConsulK8SIngressPaths])
+	require.Equal("default/foo", services["web-example-com"].Meta[ConsulK8SIngress])
+
+	require.Contains(services, "api-example-com")
+	require.Equal(443, services["api-example-com"].Port)
+	require.Equal("/,/v2", services["api-example-com"].Meta[ConsulK8SIngressPaths])
+}
+
+// Test that ingresses aren't synced unless they are enabled.
+func TestServiceIngressResource_notEnabled(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		SyncIngresses: true,
+	})
+	defer closer()
+
+	// Insert the ingress without the annotation
+	ingress := testIngress("foo")
+	delete(ingress.Annotations, annotationIngressSync)
+	_, err := client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Create(ingress)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	actual := syncer.Registrations
+	syncer.Unlock()
+	require.Len(actual, 0)
+}
+
+// Test that the registrations are removed when an ingress is disabled.
+func TestServiceIngressResource_disable(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		SyncIngresses: true,
+	})
+	defer closer()
+
+	// Insert the ingress
+	ingress := testIngress("foo")
+	_, err := client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Create(ingress)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	syncer.Lock()
+	require.Len(syncer.Registrations, 2)
+	syncer.Unlock()
+
+	// Disable the ingress
+	ingress.Annotations[annotationIngressSync] = "false"
+	_, err = client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Update(ingress)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	syncer.Lock()
+	require.Len(syncer.Registrations, 0)
+	syncer.Unlock()
+}
+
+// Test that ingresses with the same host and load balancer address
+// register separate instances, and deleting one keeps the other.
+func TestServiceIngressResource_sharedHost(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		SyncIngresses: true,
+	})
+	defer closer()
+
+	// Insert two ingresses with the same host and address
+	for _, name := range []string{"foo", "bar"} {
+		ingress := testIngress(name)
+		ingress.Spec.Rules = []extv1beta1.IngressRule{
+			testIngressRule("web.example.com", "/"+name),
+		}
+		_, err := client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Create(ingress)
+		require.NoError(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	syncer.Lock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	require.Equal(actual[0].Service.Service, actual[1].Service.Service)
+	require.NotEqual(actual[0].Service.ID, actual[1].Service.ID)
+	syncer.Unlock()
+
+	// Delete one of the ingresses
+	err := client.ExtensionsV1beta1().Ingresses(metav1.NamespaceDefault).Delete("foo", nil)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual = syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("default/bar", actual[0].Service.Meta[ConsulK8SIngress])
+	require.Equal("/bar", actual[0].Service.Meta[ConsulK8SIngressPaths])
+}
+
+// consulServiceInfo is the part of a registration the tests check.
+type consulServiceInfo struct {
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+func testIngress(name string) *extv1beta1.Ingress {
+	return &extv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annotationIngressSync: "true",
+			},
+		},
+
+		Spec: extv1beta1.IngressSpec{
+			Rules: []extv1beta1.IngressRule{
+				testIngressRule("web.example.com", ""),
+				testIngressRule("api.example.com", "/"),
+			},
+		},
+
+		Status: extv1beta1.IngressStatus{
+			LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{
+					apiv1.LoadBalancerIngress{
+						IP: "1.2.3.4",
+					},
+				},
+			},
+		},
+	}
+}
+
+func testIngressRule(host, path string) extv1beta1.IngressRule {
+	return extv1beta1.IngressRule{
+		Host: host,
+		IngressRuleValue: extv1beta1.IngressRuleValue{
+			HTTP: &extv1beta1.HTTPIngressRuleValue{
+				Paths: []extv1beta1.HTTPIngressPath{
+					extv1beta1.HTTPIngressPath{
+						Path: path,
+						Backend: extv1beta1.IngressBackend{
+							ServiceName: "web",
+						},
+					},
+				},
+			},
+		},
+	}
+}
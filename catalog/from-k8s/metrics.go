@@ -0,0 +1,57 @@
+package catalog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "consul_k8s"
+	metricsSubsystem = "sync_to_consul"
+)
+
+var (
+	// metricRegisteredInstances is the number of service instances that are
+	// currently registered in Consul by the syncer. This is updated after
+	// every sync, including the syncs of changes between full syncs.
+	metricRegisteredInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "registered_instances",
+		Help:      "Number of service instances currently registered in Consul by the syncer.",
+	})
+
+	// metricDeregistrations is the number of successful deregistrations of
+	// service instances, checks or nodes.
+	metricDeregistrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "deregistrations_total",
+		Help:      "Number of service instances, checks and nodes deregistered from Consul.",
+	})
+
+	// metricAPIErrors is the number of failed Consul API calls by operation.
+	metricAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "api_errors_total",
+		Help:      "Number of failed Consul API calls by operation.",
+	}, []string{"operation"})
+
+	// metricSyncDuration is the time taken by each full sync.
+	metricSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "full_sync_duration_seconds",
+		Help:      "Time taken to register and deregister all services in a full sync.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRegisteredInstances,
+		metricDeregistrations,
+		metricAPIErrors,
+		metricSyncDuration,
+	)
+}
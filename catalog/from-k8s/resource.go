@@ -2,9 +2,14 @@ package catalog
 
 import (
 	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/consul-k8s/helper/controller"
 	consulapi "github.com/hashicorp/consul/api"
@@ -23,11 +28,64 @@ const (
 	ConsulSourceKey   = "external-source"
 	ConsulSourceValue = "kubernetes"
 
+	// labelManagedBy and labelManagedByConsul are the label that the
+	// Consul to K8S sync sets on the services it creates. These services
+	// are never synced back to Consul.
+	labelManagedBy       = "app.kubernetes.io/managed-by"
+	labelManagedByConsul = "consul-k8s-sync-catalog"
+
 	// ConsulK8SNS is the key used in the meta to record the namespace
 	// of the service/node registration.
 	ConsulK8SNS = "external-k8s-ns"
+
+	// ConsulK8SService is the key used in the meta to record the Kubernetes
+	// service a registration was generated from, in the form of
+	// "namespace/name". This is used to report errors on the service.
+	ConsulK8SService = "external-k8s-service"
+
+	// ConsulK8SCluster is the key used in the meta to record the name of
+	// the Kubernetes cluster of the service/node registration. This allows
+	// multiple clusters to sync into the same Consul datacenter without
+	// reaping each other's services.
+	ConsulK8SCluster = "external-k8s-cluster"
+
+	// ConsulK8SHostname is the key used in the meta to record the DNS name
+	// of the pod backing an instance of a headless service. This is made up
+	// of the pod hostname and subdomain and is only resolvable within the
+	// Kubernetes cluster.
+	ConsulK8SHostname = "external-k8s-hostname"
+
+	// ConsulK8SPod, ConsulK8SPodNS and ConsulK8SNode are the keys used in the
+	// meta to record the name and namespace of the pod backing an instance of
+	// a ClusterIP service and the name of the node it is running on.
+	ConsulK8SPod   = "external-k8s-pod"
+	ConsulK8SPodNS = "external-k8s-pod-ns"
+	ConsulK8SNode  = "external-k8s-node"
+
+	// ConsulK8SReadinessCheckName and ConsulK8SReadinessCheckNotes are the
+	// name and notes of the check registered with every instance that is
+	// backed by Kubernetes endpoints. The status of this check reflects
+	// whether Kubernetes considers the address ready.
+	ConsulK8SReadinessCheckName  = "Kubernetes Readiness Check"
+	ConsulK8SReadinessCheckNotes = "Synced from Kubernetes endpoint readiness"
+
+	// defaultCheckInterval is the interval of the checks defined by
+	// annotations if the interval isn't set.
+	defaultCheckInterval = 10 * time.Second
 )
 
+const (
+	// These are the limits Consul enforces on node and service meta.
+	consulMetaMaxKeyPairs       = 64
+	consulMetaKeyMaxLength      = 128
+	consulMetaValueMaxLength    = 512
+	consulMetaKeyReservedPrefix = "consul-"
+)
+
+// invalidMetaKeyChars matches the characters that are not allowed in
+// Consul meta keys.
+var invalidMetaKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
 type NodePortSyncType string
 
 const (
@@ -43,6 +101,21 @@ const (
 	InternalOnly NodePortSyncType = "InternalOnly"
 )
 
+// ServiceIDStrategy determines how the IDs of the service instances that
+// are backed by Kubernetes endpoints are generated.
+type ServiceIDStrategy string
+
+const (
+	// Generate IDs from the name of the service and the address of the
+	// instance. This is the default.
+	ServiceIDAddress ServiceIDStrategy = "address"
+
+	// Generate IDs from the name of the service and the UID of the pod of
+	// the instance, so an address that is reused by a new pod gets a new
+	// ID. Addresses that aren't backed by a pod use the address.
+	ServiceIDPodUID ServiceIDStrategy = "pod-uid"
+)
+
 // ServiceResource implements controller.Resource to sync Service resource
 // types from K8S.
 type ServiceResource struct {
@@ -51,12 +124,35 @@ type ServiceResource struct {
 	Syncer    Syncer
 	Namespace string // K8S namespace to watch
 
+	// AllowK8SNamespaces and DenyK8SNamespaces are lists of patterns of the
+	// K8S namespaces to sync services from, using the pattern syntax of
+	// path.Match (i.e. "team-*"). If AllowK8SNamespaces is empty, then
+	// all namespaces are allowed. A namespace matching any deny pattern is
+	// never synced, even if it is also allowed.
+	//
+	// The system namespace is ignored when watching all namespaces unless
+	// it is explicitly allowed by its exact name.
+	AllowK8SNamespaces []string
+	DenyK8SNamespaces  []string
+
+	// ServiceSelector is a label selector that services must match to be
+	// synced. This is passed to the informer so that services that don't
+	// match are never loaded. If this is empty, all services are loaded.
+	ServiceSelector string
+
 	// ConsulK8STag is the tag value for services registered.
 	ConsulK8STag string
 
 	//ConsulServicePrefix prepends K8s services in Consul with a prefix
 	ConsulServicePrefix string
 
+	// ClusterName is the name of the Kubernetes cluster. If this is set,
+	// it is added to the meta of every registration and services are
+	// registered on a node named "k8s-sync-<cluster>" rather than the
+	// shared "k8s-sync" node. This must be unique for every cluster that
+	// syncs into the same Consul datacenter.
+	ClusterName string
+
 	// ExplictEnable should be set to true to require explicit enabling
 	// using annotations. If this is false, then services are implicitly
 	// enabled (aka default enabled).
@@ -71,6 +167,34 @@ type ServiceResource struct {
 	// ip address will be used instead.
 	NodePortSync NodePortSyncType
 
+	// SyncK8SNodes set to true registers ClusterIP and NodePort service
+	// instances on a Consul node named after the Kubernetes node the
+	// endpoint is running on rather than the shared "k8s-sync" node. The
+	// Consul node uses the node's InternalIP as its address and the node's
+	// labels as node meta.
+	//
+	// This should not be enabled if Consul client agents run with the same
+	// node names as the Kubernetes nodes, since the agents would remove the
+	// synced services during anti-entropy.
+	SyncK8SNodes bool
+
+	// SyncIngresses set to true also watches Ingress resources and
+	// registers a service for every host of the ingresses that are enabled
+	// with the ingress-sync annotation. The instances of the services are
+	// the load balancer addresses of the ingress.
+	SyncIngresses bool
+
+	// ServiceIDStrategy is how the IDs of the instances of ClusterIP and
+	// NodePort services are generated. Instances of headless services that
+	// have a hostname always use the hostname.
+	ServiceIDStrategy ServiceIDStrategy
+
+	// PodLabels are the keys of the pod labels to add to the meta of the
+	// instances of ClusterIP services that are backed by pods, such as
+	// "version". If this is set, then pods are watched so the meta is
+	// updated when the labels change.
+	PodLabels []string
+
 	// serviceMap is a mapping of unique key (given by controller) to
 	// the service structure. endpointsMap is the mapping of the same
 	// uniqueKey to a set of endpoints.
@@ -80,6 +204,25 @@ type ServiceResource struct {
 	serviceMap   map[string]*apiv1.Service
 	endpointsMap map[string]*apiv1.Endpoints
 	consulMap    map[string][]*consulapi.CatalogRegistration
+
+	// podMap is a mapping of the key of a pod to the parts of the pod
+	// that are used for registrations. nodeMap is a mapping of the name of
+	// a node to the node. podIndex and nodeIndex track the services with
+	// instances on each pod and node, so the services can be regenerated
+	// when they change.
+	podMap    map[string]*podInfo
+	nodeMap   map[string]*apiv1.Node
+	podIndex  serviceIndex
+	nodeIndex serviceIndex
+
+	// stopCh is the channel given to Run and watchingNodes is true once
+	// the node watcher is started. Nodes are only watched once they are
+	// needed, since this requires permission to list and watch nodes.
+	// Until then they are requested from K8S.
+	//
+	// serviceLock must be held for any read/write to these.
+	stopCh        <-chan struct{}
+	watchingNodes bool
 }
 
 // Informer implements the controller.Resource interface.
@@ -87,10 +230,12 @@ func (t *ServiceResource) Informer() cache.SharedIndexInformer {
 	return cache.NewSharedIndexInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = t.ServiceSelector
 				return t.Client.CoreV1().Services(t.namespace()).List(options)
 			},
 
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = t.ServiceSelector
 				return t.Client.CoreV1().Services(t.namespace()).Watch(options)
 			},
 		},
@@ -152,6 +297,8 @@ func (t *ServiceResource) Delete(key string) error {
 	t.serviceLock.Lock()
 	defer t.serviceLock.Unlock()
 	delete(t.serviceMap, key)
+	t.podIndex.Forget(key)
+	t.nodeIndex.Forget(key)
 	delete(t.endpointsMap, key)
 
 	// If there were registrations related to this service, then
@@ -167,24 +314,88 @@ func (t *ServiceResource) Delete(key string) error {
 
 // Run implements the controller.Backgrounder interface.
 func (t *ServiceResource) Run(ch <-chan struct{}) {
+	if t.SyncIngresses {
+		t.Log.Info("starting runner for ingresses")
+		go (&controller.Controller{
+			Name:     "to-consul/ingress",
+			Log:      t.Log.Named("controller/ingress"),
+			Resource: &serviceIngressResource{Service: t},
+		}).Run(ch)
+	}
+
+	if len(t.PodLabels) > 0 {
+		t.Log.Info("starting runner for pods")
+		go (&controller.Controller{
+			Name:     "to-consul/pods",
+			Log:      t.Log.Named("controller/pods"),
+			Resource: &servicePodResource{Service: t},
+		}).Run(ch)
+	}
+
+	t.serviceLock.Lock()
+	t.stopCh = ch
+	if t.SyncK8SNodes {
+		t.watchNodesLocked()
+	}
+	t.serviceLock.Unlock()
+
 	t.Log.Info("starting runner for endpoints")
 	(&controller.Controller{
+		Name:     "to-consul/endpoints",
 		Log:      t.Log.Named("controller/endpoints"),
 		Resource: &serviceEndpointsResource{Service: t},
 	}).Run(ch)
 }
 
+// watchNodesLocked starts the node watcher if it isn't running yet. This
+// is done once instances are registered on the K8S nodes or NodePort
+// services are synced.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) watchNodesLocked() {
+	if t.watchingNodes || t.stopCh == nil {
+		return
+	}
+	t.watchingNodes = true
+
+	t.Log.Info("starting runner for nodes")
+	go (&controller.Controller{
+		Name:     "to-consul/nodes",
+		Log:      t.Log.Named("controller/nodes"),
+		Resource: &serviceNodeResource{Service: t},
+	}).Run(t.stopCh)
+}
+
 // shouldSync returns true if resyncing should be enabled for the given service.
 func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
 	// If we're listening on all namespaces, we explicitly ignore the
 	// system namespace. The user can explicitly enable this by starting
 	// a sync for that namespace.
-	if t.namespace() == metav1.NamespaceAll && svc.Namespace == metav1.NamespaceSystem {
+	if t.namespace() == metav1.NamespaceAll &&
+		svc.Namespace == metav1.NamespaceSystem &&
+		!containsString(t.AllowK8SNamespaces, metav1.NamespaceSystem) {
 		t.Log.Debug("ignoring system service since we're listening on all namespaces",
 			"service-name", t.prefixServiceName(svc.Name))
 		return false
 	}
 
+	// Ignore services in namespaces that aren't allowed
+	if !t.namespaceAllowed(svc.Namespace) {
+		t.Log.Debug("ignoring service since its namespace isn't allowed",
+			"service-name", t.prefixServiceName(svc.Name),
+			"namespace", svc.Namespace)
+		return false
+	}
+
+	// Never sync services created by the Consul to K8S sync back to Consul,
+	// even if they are annotated to be synced, since they would loop
+	// between the two.
+	if svc.Labels[labelManagedBy] == labelManagedByConsul {
+		t.Log.Debug("ignoring service since it was synced from Consul",
+			"service-name", t.prefixServiceName(svc.Name))
+		return false
+	}
+
 	// Ignore ClusterIP services if ClusterIP sync is disabled
 	if svc.Spec.Type == apiv1.ServiceTypeClusterIP && !t.ClusterIPSync {
 		return false
@@ -209,6 +420,46 @@ func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
 	return v
 }
 
+// namespaceAllowed returns true if services in the given namespace are
+// allowed to be synced by the allow and deny lists.
+func (t *ServiceResource) namespaceAllowed(ns string) bool {
+	for _, pattern := range t.DenyK8SNamespaces {
+		if matchNamespace(pattern, ns) {
+			return false
+		}
+	}
+
+	if len(t.AllowK8SNamespaces) == 0 {
+		return true
+	}
+
+	for _, pattern := range t.AllowK8SNamespaces {
+		if matchNamespace(pattern, ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchNamespace returns true if the namespace matches the given pattern.
+// Invalid patterns never match.
+func matchNamespace(pattern, ns string) bool {
+	ok, err := path.Match(pattern, ns)
+	return err == nil && ok
+}
+
+// containsString returns true if the string is in the given slice.
+func containsString(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
+
 // shouldTrackEndpoints returns true if the endpoints for the given key
 // should be tracked.
 //
@@ -216,8 +467,8 @@ func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
 func (t *ServiceResource) shouldTrackEndpoints(key string) bool {
 	// The service must be one we care about for us to watch the endpoints.
 	// We care about a service that exists in our service map (is enabled
-	// for syncing) and is a NodePort type. Only NodePort type services
-	// use the endpoints at all.
+	// for syncing) and is a NodePort or ClusterIP type, or whose weight is
+	// the number of endpoints.
 	if t.serviceMap == nil {
 		return false
 	}
@@ -226,7 +477,9 @@ func (t *ServiceResource) shouldTrackEndpoints(key string) bool {
 		return false
 	}
 
-	return svc.Spec.Type == apiv1.ServiceTypeNodePort || svc.Spec.Type == apiv1.ServiceTypeClusterIP
+	return svc.Spec.Type == apiv1.ServiceTypeNodePort ||
+		svc.Spec.Type == apiv1.ServiceTypeClusterIP ||
+		svc.Annotations[annotationServiceWeightPassing] == weightEndpoints
 }
 
 // generateRegistrations generates the necessary Consul registrations for
@@ -249,28 +502,30 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// Begin by always clearing the old value out since we'll regenerate
 	// a new one if there is one.
 	delete(t.consulMap, key)
+	t.podIndex.Forget(key)
+	t.nodeIndex.Forget(key)
 
 	// baseNode and baseService are the base that should be modified with
 	// service-type specific changes. These are not pointers, they should be
 	// shallow copied for each instance.
-	baseNode := consulapi.CatalogRegistration{
-		SkipNodeUpdate: true,
-		Node:           "k8s-sync",
-		Address:        "127.0.0.1",
-		NodeMeta: map[string]string{
-			ConsulSourceKey: ConsulSourceValue,
-		},
-	}
+	baseNode := t.baseNode()
 
 	baseService := consulapi.AgentService{
 		Service: t.prefixServiceName(svc.Name),
 		Tags:    []string{t.ConsulK8STag},
 		Meta: map[string]string{
-			ConsulSourceKey: ConsulSourceValue,
-			ConsulK8SNS:     t.namespace(),
+			ConsulSourceKey:  ConsulSourceValue,
+			ConsulK8SNS:      t.namespace(),
+			ConsulK8SService: key,
 		},
 	}
 
+	// If the cluster is named, record it so that only this cluster's
+	// syncer reaps the registrations.
+	if t.ClusterName != "" {
+		baseService.Meta[ConsulK8SCluster] = t.ClusterName
+	}
+
 	// If the name is explicitly annotated, adopt that name
 	if v, ok := svc.Annotations[annotationServiceName]; ok {
 		baseService.Service = strings.TrimSpace(v)
@@ -355,6 +610,19 @@ func (t *ServiceResource) generateRegistrations(key string) {
 			"instances", len(t.consulMap[key]))
 	}()
 
+	// Add the checks and weights defined by annotations once the instances
+	// are generated. This is deferred before splitting the ports so that
+	// the checks use the port of each split instance.
+	defer t.addCustomChecks(key, svc)
+	defer t.setWeights(key, svc)
+
+	// If every port should be registered as its own service, then split
+	// the instances once they're generated. This is deferred so that it
+	// applies to every type of service below.
+	if t.shouldSplitPorts(svc) {
+		defer t.splitPortRegistrations(key, svc)
+	}
+
 	// If there are external IPs then those become the instance registrations
 	// for any type of service.
 	if ips := svc.Spec.ExternalIPs; len(ips) > 0 {
@@ -370,6 +638,24 @@ func (t *ServiceResource) generateRegistrations(key string) {
 		return
 	}
 
+	// getNode looks up nodes in the cache of the node watcher. The nodes
+	// are tracked so the service is regenerated when they change, which
+	// also registers the instances on nodes that aren't loaded yet. If the
+	// nodes aren't watched, then they are requested from K8S.
+	getNode := func(name string) (*apiv1.Node, error) {
+		t.nodeIndex.Add(key, name)
+		if !t.watchingNodes {
+			return t.Client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		}
+
+		node, ok := t.nodeMap[name]
+		if !ok {
+			return nil, fmt.Errorf("node %q not found", name)
+		}
+
+		return node, nil
+	}
+
 	switch svc.Spec.Type {
 	// For LoadBalancer type services, we create a service instance for
 	// each LoadBalancer entry. We only support entries that have an IP
@@ -403,6 +689,7 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// pods are running on. This way we don't register _every_ K8S
 	// node as part of the service.
 	case apiv1.ServiceTypeNodePort:
+		t.watchNodesLocked()
 		if t.endpointsMap == nil {
 			return
 		}
@@ -413,7 +700,7 @@ func (t *ServiceResource) generateRegistrations(key string) {
 		}
 
 		for _, subset := range endpoints.Subsets {
-			for _, subsetAddr := range subset.Addresses {
+			for _, subsetAddr := range subsetAddresses(subset) {
 				// Check that the node name exists
 				// subsetAddr.NodeName is of type *string
 				if subsetAddr.NodeName == nil {
@@ -421,9 +708,9 @@ func (t *ServiceResource) generateRegistrations(key string) {
 				}
 
 				// Look up the node's ip address by getting node info
-				node, err := t.Client.CoreV1().Nodes().Get(*subsetAddr.NodeName, metav1.GetOptions{})
+				node, err := getNode(*subsetAddr.NodeName)
 				if err != nil {
-					t.Log.Warn("error getting node info", "error", err)
+					t.Log.Debug("error getting node info", "error", err)
 					continue
 				}
 
@@ -444,8 +731,12 @@ func (t *ServiceResource) generateRegistrations(key string) {
 						r := baseNode
 						rs := baseService
 						r.Service = &rs
-						r.Service.ID = serviceID(r.Service.Service, subsetAddr.IP)
+						r.Service.ID = t.instanceID(r.Service.Service, subsetAddr.IP, subsetAddr)
 						r.Service.Address = address.Address
+						if t.SyncK8SNodes {
+							t.setK8SNode(&r, node)
+						}
+						r.Checks = consulapi.HealthChecks{readinessCheck(&r, subsetAddr.Ready)}
 
 						t.consulMap[key] = append(t.consulMap[key], &r)
 					}
@@ -459,8 +750,12 @@ func (t *ServiceResource) generateRegistrations(key string) {
 							r := baseNode
 							rs := baseService
 							r.Service = &rs
-							r.Service.ID = serviceID(r.Service.Service, subsetAddr.IP)
+							r.Service.ID = t.instanceID(r.Service.Service, subsetAddr.IP, subsetAddr)
 							r.Service.Address = address.Address
+							if t.SyncK8SNodes {
+								t.setK8SNode(&r, node)
+							}
+							r.Checks = consulapi.HealthChecks{readinessCheck(&r, subsetAddr.Ready)}
 
 							t.consulMap[key] = append(t.consulMap[key], &r)
 						}
@@ -469,13 +764,34 @@ func (t *ServiceResource) generateRegistrations(key string) {
 			}
 		}
 
+	// For ExternalName services, we register a single instance with
+	// the DNS name as its address.
+	case apiv1.ServiceTypeExternalName:
+		addr := strings.TrimSuffix(svc.Spec.ExternalName, ".")
+		if addr == "" {
+			return
+		}
+
+		r := baseNode
+		rs := baseService
+		r.Service = &rs
+		r.Service.ID = serviceID(r.Service.Service, addr)
+		r.Service.Address = addr
+
+		t.consulMap[key] = append(t.consulMap[key], &r)
+
 	// For ClusterIP services, we register a service instance
-	// for each pod.
+	// for each pod. Addresses that are not ready are registered as well
+	// with a critical readiness check so Consul won't route to them.
+	// Headless services are registered the same way since the pods
+	// are the only addresses they have.
 	case apiv1.ServiceTypeClusterIP:
 		if t.endpointsMap == nil {
 			return
 		}
 
+		headless := svc.Spec.ClusterIP == apiv1.ClusterIPNone
+
 		endpoints := t.endpointsMap[key]
 		if endpoints == nil {
 			return
@@ -483,14 +799,8 @@ func (t *ServiceResource) generateRegistrations(key string) {
 
 		seen := map[string]struct{}{}
 		for _, subset := range endpoints.Subsets {
-			for _, subsetAddr := range subset.Addresses {
+			for _, subsetAddr := range subsetAddresses(subset) {
 				addr := subsetAddr.IP
-				if addr == "" {
-					addr = subsetAddr.Hostname
-				}
-				if addr == "" {
-					continue
-				}
 
 				// Its not clear whether K8S guarantees ready addresses to
 				// be unique so we maintain a set to prevent duplicates just
@@ -503,12 +813,483 @@ func (t *ServiceResource) generateRegistrations(key string) {
 				r := baseNode
 				rs := baseService
 				r.Service = &rs
-				r.Service.ID = serviceID(r.Service.Service, addr)
+				r.Service.ID = t.instanceID(r.Service.Service, addr, subsetAddr)
 				r.Service.Address = addr
 
+				// Pods backing headless services can have a stable hostname,
+				// for example the pods of a StatefulSet. We use it for the
+				// ID so the instance keeps its ID if the pod IP changes.
+				if headless && subsetAddr.Hostname != "" {
+					if hostname := t.podHostname(key, subsetAddr); hostname != "" {
+						r.Service.ID = serviceID(r.Service.Service, hostname)
+						r.Service.Meta = copyMeta(baseService.Meta)
+						r.Service.Meta[ConsulK8SHostname] = hostname
+					}
+				}
+				t.setPodMeta(&r, key, subsetAddr)
+
+				// Register on the node the pod is running on if enabled.
+				// If the node can't be found we fall back to the base node.
+				if t.SyncK8SNodes && subsetAddr.NodeName != nil {
+					node, err := getNode(*subsetAddr.NodeName)
+					if err != nil {
+						t.Log.Debug("error getting node info", "error", err)
+					} else {
+						t.setK8SNode(&r, node)
+					}
+				}
+				r.Checks = consulapi.HealthChecks{readinessCheck(&r, subsetAddr.Ready)}
+
 				t.consulMap[key] = append(t.consulMap[key], &r)
 			}
 		}
+
+	default:
+		t.Log.Debug("unsupported service type, not registering",
+			"key", key,
+			"type", svc.Spec.Type)
+	}
+}
+
+// setWeights sets the weights defined by the weight annotations of the
+// given service on every instance registration generated for the key.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) setWeights(key string, svc *apiv1.Service) {
+	passingRaw, ok := svc.Annotations[annotationServiceWeightPassing]
+	if !ok {
+		return
+	}
+
+	var passing int
+	if passingRaw == weightEndpoints {
+		// Consul requires a passing weight of at least 1, so instances
+		// without ready endpoints get the lowest weight. Instances that
+		// are registered for each endpoint stand for a single endpoint.
+		passing = 1
+		if n := t.readyEndpoints(key); n > 1 && !perEndpointInstances(svc) {
+			passing = n
+		}
+	} else {
+		v, err := strconv.Atoi(passingRaw)
+		if err != nil || v < 1 {
+			t.Log.Warn("invalid service-weight-passing annotation, not setting weights",
+				"key", key,
+				"value", passingRaw)
+			return
+		}
+		passing = v
+	}
+
+	warning := 1
+	if v, ok := svc.Annotations[annotationServiceWeightWarning]; ok {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 0 {
+			t.Log.Warn("invalid service-weight-warning annotation, using default",
+				"key", key,
+				"value", v)
+		} else {
+			warning = w
+		}
+	}
+
+	for _, r := range t.consulMap[key] {
+		r.Service.Weights = consulapi.AgentWeights{Passing: passing, Warning: warning}
+	}
+}
+
+// readyEndpoints returns the number of ready endpoints of the service with
+// the given key. An endpoint is listed in every subset for the ports it
+// serves, so endpoints are counted by the UID of their pod, or by their IP
+// if they aren't backed by a pod.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) readyEndpoints(key string) int {
+	endpoints := t.endpointsMap[key]
+	if endpoints == nil {
+		return 0
+	}
+
+	seen := make(map[string]struct{})
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			id := addr.IP
+			if ref := addr.TargetRef; ref != nil && ref.UID != "" {
+				id = string(ref.UID)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+
+	return len(seen)
+}
+
+// perEndpointInstances returns true if an instance is registered for each
+// endpoint of the given service, rather than for each address of the
+// service as a whole.
+func perEndpointInstances(svc *apiv1.Service) bool {
+	if len(svc.Spec.ExternalIPs) > 0 {
+		return false
+	}
+
+	switch svc.Spec.Type {
+	case apiv1.ServiceTypeNodePort, apiv1.ServiceTypeClusterIP:
+		return true
+	default:
+		return false
+	}
+}
+
+// addCustomChecks adds the checks defined by the check annotations of the
+// given service to every instance registration generated for the key.
+//
+// Consul doesn't run checks registered through the catalog, so these must
+// be run by consul-esm. They are registered as passing since the readiness
+// of each instance is already reflected by its readiness check, and keep
+// the status set by consul-esm once they are registered.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) addCustomChecks(key string, svc *apiv1.Service) {
+	httpTarget, hasHTTP := svc.Annotations[annotationServiceCheckHTTP]
+	tcpTarget, hasTCP := svc.Annotations[annotationServiceCheckTCP]
+	if !hasHTTP && !hasTCP {
+		return
+	}
+
+	interval := defaultCheckInterval
+	if v, ok := svc.Annotations[annotationServiceCheckInterval]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			t.Log.Warn("error parsing service-check-interval annotation, using default",
+				"key", key,
+				"err", err)
+		} else {
+			interval = d
+		}
+	}
+
+	for _, r := range t.consulMap[key] {
+		replacer := strings.NewReplacer(
+			"${address}", r.Service.Address,
+			"${port}", strconv.Itoa(r.Service.Port))
+
+		check := func(checkType string) *consulapi.HealthCheck {
+			return &consulapi.HealthCheck{
+				Node:        r.Node,
+				CheckID:     customCheckID(r.Service.ID, checkType),
+				Name:        fmt.Sprintf("Service '%s' %s check", r.Service.Service, checkType),
+				ServiceID:   r.Service.ID,
+				ServiceName: r.Service.Service,
+				Status:      consulapi.HealthPassing,
+				Definition: consulapi.HealthCheckDefinition{
+					IntervalDuration: interval,
+				},
+			}
+		}
+
+		if hasHTTP {
+			c := check("http")
+			c.Definition.HTTP = replacer.Replace(httpTarget)
+			r.Checks = append(r.Checks, c)
+		}
+		if hasTCP {
+			c := check("tcp")
+			c.Definition.TCP = replacer.Replace(tcpTarget)
+			r.Checks = append(r.Checks, c)
+		}
+	}
+}
+
+// copyMeta returns a copy of the given meta so that it can be modified
+// for a single instance without affecting the other instances.
+func copyMeta(meta map[string]string) map[string]string {
+	result := make(map[string]string, len(meta))
+	for k, v := range meta {
+		result[k] = v
+	}
+
+	return result
+}
+
+// shouldSplitPorts returns true if each port of the given service should
+// be registered as a separate Consul service.
+func (t *ServiceResource) shouldSplitPorts(svc *apiv1.Service) bool {
+	raw, ok := svc.Annotations[annotationServiceMultiPort]
+	if !ok || len(svc.Spec.Ports) == 0 {
+		return false
+	}
+
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		t.Log.Warn("error parsing service-multi-port annotation",
+			"service-name", t.prefixServiceName(svc.Name),
+			"err", err)
+		return false
+	}
+
+	return v
+}
+
+// splitPortRegistrations replaces the generated registrations for the given
+// key with one registration per instance and port of the service. Each is
+// registered as a service named "<service>-<port name>" using that port and
+// is tagged with the port protocol.
+//
+// Precondition: the lock t.lock is held.
+func (t *ServiceResource) splitPortRegistrations(key string, svc *apiv1.Service) {
+	isNodePort := svc.Spec.Type == apiv1.ServiceTypeNodePort
+
+	var result []*consulapi.CatalogRegistration
+	for _, r := range t.consulMap[key] {
+		for _, p := range svc.Spec.Ports {
+			name := p.Name
+			if name == "" {
+				name = strconv.FormatInt(int64(p.Port), 10)
+			}
+
+			port := int(p.Port)
+			if isNodePort && p.NodePort > 0 {
+				port = int(p.NodePort)
+			}
+
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = apiv1.ProtocolTCP
+			}
+
+			rp := *r
+			rs := *r.Service
+			rp.Service = &rs
+			rs.Service = fmt.Sprintf("%s-%s", r.Service.Service, name)
+			rs.ID = serviceID(rs.Service, r.Service.ID)
+			rs.Port = port
+			rs.Tags = append(append([]string{}, r.Service.Tags...),
+				strings.ToLower(string(protocol)))
+
+			// Checks belong to a specific service instance so they must
+			// be moved to the new instance.
+			rp.Checks = nil
+			for _, c := range r.Checks {
+				rc := *c
+				rc.CheckID = rs.ID + strings.TrimPrefix(c.CheckID, r.Service.ID)
+				rc.ServiceID = rs.ID
+				rc.ServiceName = rs.Service
+				rp.Checks = append(rp.Checks, &rc)
+			}
+
+			result = append(result, &rp)
+		}
+	}
+
+	t.consulMap[key] = result
+}
+
+// setK8SNode updates the registration so that the instance is registered
+// on a Consul node representing the given Kubernetes node. If the node
+// has no InternalIP then the registration is left unchanged.
+func (t *ServiceResource) setK8SNode(r *consulapi.CatalogRegistration, node *apiv1.Node) {
+	var addr string
+	for _, address := range node.Status.Addresses {
+		if address.Type == apiv1.NodeInternalIP {
+			addr = address.Address
+			break
+		}
+	}
+	if addr == "" {
+		t.Log.Debug("node has no internal ip, using default node",
+			"node-name", node.Name)
+		return
+	}
+
+	r.Node = node.Name
+	r.Address = addr
+	r.NodeMeta = k8sNodeMeta(node, t.ClusterName)
+
+	// We own the node registration, so keep the node data up to date.
+	r.SkipNodeUpdate = false
+}
+
+// k8sNodeMeta returns the Consul node meta for the given Kubernetes node
+// in the cluster with the given name, which may be empty. Label keys are
+// sanitized to the characters Consul allows in meta keys and any labels
+// that can't be represented in Consul are skipped.
+func k8sNodeMeta(node *apiv1.Node, clusterName string) map[string]string {
+	meta := map[string]string{
+		ConsulSourceKey: ConsulSourceValue,
+	}
+	if clusterName != "" {
+		meta[ConsulK8SCluster] = clusterName
+	}
+
+	// Sort the keys so that we deterministically pick the same labels
+	// if there are more labels than Consul allows.
+	keys := make([]string, 0, len(node.Labels))
+	for k := range node.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(meta) >= consulMetaMaxKeyPairs {
+			break
+		}
+
+		v := node.Labels[k]
+		k = invalidMetaKeyChars.ReplaceAllString(k, "_")
+		if len(k) > consulMetaKeyMaxLength ||
+			len(v) > consulMetaValueMaxLength ||
+			strings.HasPrefix(k, consulMetaKeyReservedPrefix) {
+			continue
+		}
+		if _, ok := meta[k]; ok {
+			continue
+		}
+
+		meta[k] = v
+	}
+
+	return meta
+}
+
+// endpointAddress is an address from an endpoint subset along with
+// whether Kubernetes considers that address ready.
+type endpointAddress struct {
+	apiv1.EndpointAddress
+	Ready bool
+}
+
+// subsetAddresses returns all the addresses of the given subset. The
+// ready addresses are always returned first so that they take precedence
+// if the same address is also listed as not ready.
+func subsetAddresses(subset apiv1.EndpointSubset) []endpointAddress {
+	result := make([]endpointAddress, 0, len(subset.Addresses)+len(subset.NotReadyAddresses))
+	for _, addr := range subset.Addresses {
+		result = append(result, endpointAddress{EndpointAddress: addr, Ready: true})
+	}
+	for _, addr := range subset.NotReadyAddresses {
+		result = append(result, endpointAddress{EndpointAddress: addr, Ready: false})
+	}
+
+	return result
+}
+
+// instanceID returns the ID of the instance of the service with the given
+// name for the given endpoint address, using the given address for the
+// ID unless the ID strategy says otherwise.
+func (t *ServiceResource) instanceID(name, addr string, subsetAddr endpointAddress) string {
+	if t.ServiceIDStrategy == ServiceIDPodUID {
+		if ref := subsetAddr.TargetRef; ref != nil && ref.Kind == "Pod" && ref.UID != "" {
+			return serviceID(name, string(ref.UID))
+		}
+	}
+
+	return serviceID(name, addr)
+}
+
+// podHostname returns the DNS name of the pod backing the given endpoint
+// address of the headless service with the given key, built from the
+// hostname and subdomain of the pod. This returns "" if the pod has no
+// subdomain or can't be found. The pod is looked up in the cache of the
+// pod watcher if it's running, and from Kubernetes otherwise.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) podHostname(key string, addr endpointAddress) string {
+	ref := addr.TargetRef
+	if ref == nil || ref.Kind != "Pod" || ref.Name == "" {
+		return ""
+	}
+
+	var hostname, subdomain string
+	if len(t.PodLabels) > 0 {
+		podKey := ref.Namespace + "/" + ref.Name
+		t.podIndex.Add(key, podKey)
+
+		pod, ok := t.podMap[podKey]
+		if !ok {
+			return ""
+		}
+		hostname, subdomain = pod.Hostname, pod.Subdomain
+	} else {
+		pod, err := t.Client.CoreV1().Pods(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Log.Debug("error getting pod info", "error", err)
+			return ""
+		}
+		hostname, subdomain = pod.Spec.Hostname, pod.Spec.Subdomain
+	}
+
+	if hostname == "" || subdomain == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s.%s.%s.svc", hostname, subdomain, ref.Namespace)
+}
+
+// setPodMeta adds the meta of the pod backing the given endpoint address
+// to the given instance registration of the service with the given key.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) setPodMeta(r *consulapi.CatalogRegistration, key string, addr endpointAddress) {
+	ref := addr.TargetRef
+	if ref == nil || ref.Kind != "Pod" || ref.Name == "" {
+		return
+	}
+
+	meta := copyMeta(r.Service.Meta)
+	meta[ConsulK8SPod] = ref.Name
+	meta[ConsulK8SPodNS] = ref.Namespace
+	if addr.NodeName != nil {
+		meta[ConsulK8SNode] = *addr.NodeName
+	}
+
+	if len(t.PodLabels) > 0 {
+		podKey := ref.Namespace + "/" + ref.Name
+		t.podIndex.Add(key, podKey)
+
+		var labels map[string]string
+		if pod, ok := t.podMap[podKey]; ok {
+			labels = pod.Labels
+		}
+		for _, k := range t.PodLabels {
+			v, ok := labels[k]
+			if !ok {
+				continue
+			}
+
+			k = invalidMetaKeyChars.ReplaceAllString(k, "_")
+			if len(meta) >= consulMetaMaxKeyPairs ||
+				len(k) > consulMetaKeyMaxLength ||
+				len(v) > consulMetaValueMaxLength ||
+				strings.HasPrefix(k, consulMetaKeyReservedPrefix) {
+				continue
+			}
+			if _, ok := meta[k]; ok {
+				continue
+			}
+
+			meta[k] = v
+		}
+	}
+
+	r.Service.Meta = meta
+}
+
+// readinessCheck returns the check for the service instance in the given
+// registration that reflects the readiness of the instance in Kubernetes.
+func readinessCheck(r *consulapi.CatalogRegistration, ready bool) *consulapi.HealthCheck {
+	status := consulapi.HealthPassing
+	if !ready {
+		status = consulapi.HealthCritical
+	}
+
+	return &consulapi.HealthCheck{
+		Node:        r.Node,
+		CheckID:     readinessCheckID(r.Service.ID),
+		Name:        ConsulK8SReadinessCheckName,
+		Notes:       ConsulK8SReadinessCheckNotes,
+		Status:      status,
+		ServiceID:   r.Service.ID,
+		ServiceName: r.Service.Service,
 	}
 }
 
@@ -538,6 +1319,223 @@ func (t *ServiceResource) namespace() string {
 	return metav1.NamespaceAll
 }
 
+// podInfo is the part of a pod that is used for the registrations of the
+// services it backs.
+type podInfo struct {
+	// Labels are the labels of the pod that are in PodLabels.
+	Labels map[string]string
+
+	// Hostname and Subdomain are from the pod spec, and give the pods
+	// backing headless services a DNS name.
+	Hostname  string
+	Subdomain string
+}
+
+// servicePodResource implements controller.Resource and starts a
+// background watcher on pods that is used by the ServiceResource to keep
+// track of the labels and hostnames of the pods backing registered
+// services.
+type servicePodResource struct {
+	Service *ServiceResource
+}
+
+func (t *servicePodResource) Informer() cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.Service.Client.CoreV1().
+					Pods(t.Service.namespace()).
+					List(options)
+			},
+
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.Service.Client.CoreV1().
+					Pods(t.Service.namespace()).
+					Watch(options)
+			},
+		},
+		&apiv1.Pod{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+func (t *servicePodResource) Upsert(key string, raw interface{}) error {
+	svc := t.Service
+	pod, ok := raw.(*apiv1.Pod)
+	if !ok {
+		svc.Log.Warn("upsert got invalid type", "raw", raw)
+		return nil
+	}
+
+	// Only the labels that are added to the meta are stored.
+	info := &podInfo{
+		Labels:    make(map[string]string),
+		Hostname:  pod.Spec.Hostname,
+		Subdomain: pod.Spec.Subdomain,
+	}
+	for _, k := range svc.PodLabels {
+		if v, ok := pod.Labels[k]; ok {
+			info.Labels[k] = v
+		}
+	}
+
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	if current, ok := svc.podMap[key]; ok && reflect.DeepEqual(current, info) {
+		return nil
+	}
+	if svc.podMap == nil {
+		svc.podMap = make(map[string]*podInfo)
+	}
+	svc.podMap[key] = info
+
+	// Regenerate the services with instances backed by the pod.
+	svc.regenerate(svc.podIndex.Services(key))
+
+	svc.Log.Debug("upsert pod", "key", key)
+	return nil
+}
+
+func (t *servicePodResource) Delete(key string) error {
+	t.Service.serviceLock.Lock()
+	defer t.Service.serviceLock.Unlock()
+
+	// The endpoints change when a pod is deleted, so the services backed
+	// by it are regenerated then.
+	delete(t.Service.podMap, key)
+
+	t.Service.Log.Debug("delete pod", "key", key)
+	return nil
+}
+
+// serviceNodeResource implements controller.Resource and starts a
+// background watcher on nodes that is used by the ServiceResource to look
+// up the addresses of the nodes that instances are running on.
+type serviceNodeResource struct {
+	Service *ServiceResource
+}
+
+func (t *serviceNodeResource) Informer() cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.Service.Client.CoreV1().Nodes().List(options)
+			},
+
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.Service.Client.CoreV1().Nodes().Watch(options)
+			},
+		},
+		&apiv1.Node{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+func (t *serviceNodeResource) Upsert(key string, raw interface{}) error {
+	svc := t.Service
+	node, ok := raw.(*apiv1.Node)
+	if !ok {
+		svc.Log.Warn("upsert got invalid type", "raw", raw)
+		return nil
+	}
+
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	// Nodes are updated often, such as for their heartbeats, so the
+	// services are only regenerated if the fields they use change.
+	current, ok := svc.nodeMap[key]
+	if svc.nodeMap == nil {
+		svc.nodeMap = make(map[string]*apiv1.Node)
+	}
+	svc.nodeMap[key] = node
+	if ok && reflect.DeepEqual(current.Status.Addresses, node.Status.Addresses) &&
+		reflect.DeepEqual(current.Labels, node.Labels) {
+		return nil
+	}
+
+	svc.regenerate(svc.nodeIndex.Services(key))
+	svc.Log.Debug("upsert node", "key", key)
+	return nil
+}
+
+func (t *serviceNodeResource) Delete(key string) error {
+	t.Service.serviceLock.Lock()
+	defer t.Service.serviceLock.Unlock()
+
+	delete(t.Service.nodeMap, key)
+	t.Service.regenerate(t.Service.nodeIndex.Services(key))
+
+	t.Service.Log.Debug("delete node", "key", key)
+	return nil
+}
+
+// regenerate regenerates the registrations of the services with the given
+// keys and syncs them if there are any.
+//
+// Precondition: lock must be held
+func (t *ServiceResource) regenerate(keys []string) {
+	for _, k := range keys {
+		t.generateRegistrations(k)
+	}
+	if len(keys) > 0 {
+		t.sync()
+	}
+}
+
+// serviceIndex tracks the objects, such as pods or nodes, that the
+// instances of each service are generated from so that services can be
+// regenerated when the objects change. The zero value is ready to use.
+type serviceIndex struct {
+	objects  map[string][]string            // service key to object keys
+	services map[string]map[string]struct{} // object key to service keys
+}
+
+// Add records that the service with the given key has instances generated
+// from the object with the given key.
+func (i *serviceIndex) Add(service, object string) {
+	if i.services == nil {
+		i.services = make(map[string]map[string]struct{})
+		i.objects = make(map[string][]string)
+	}
+	if i.services[object] == nil {
+		i.services[object] = make(map[string]struct{})
+	}
+	if _, ok := i.services[object][service]; ok {
+		return
+	}
+
+	i.services[object][service] = struct{}{}
+	i.objects[service] = append(i.objects[service], object)
+}
+
+// Forget removes the objects of the service with the given key.
+func (i *serviceIndex) Forget(service string) {
+	for _, object := range i.objects[service] {
+		delete(i.services[object], service)
+		if len(i.services[object]) == 0 {
+			delete(i.services, object)
+		}
+	}
+	delete(i.objects, service)
+}
+
+// Services returns the keys of the services with instances generated from
+// the object with the given key. This is a copy so it can be used while
+// the services are regenerated.
+func (i *serviceIndex) Services(object string) []string {
+	result := make([]string, 0, len(i.services[object]))
+	for service := range i.services[object] {
+		result = append(result, service)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
 // serviceEndpointsResource implements controller.Resource and starts
 // a background watcher on endpoints that is used by the ServiceResource
 // to keep track of changing endpoints for registered services.
@@ -614,6 +1612,27 @@ func (t *serviceEndpointsResource) Delete(key string) error {
 	return nil
 }
 
+// baseNode returns the registration of the node that instances are
+// registered on unless they are registered on their Kubernetes node. If
+// the cluster is named, the node is specific to the cluster so that only
+// this cluster's syncer reaps it.
+func (t *ServiceResource) baseNode() consulapi.CatalogRegistration {
+	r := consulapi.CatalogRegistration{
+		SkipNodeUpdate: true,
+		Node:           "k8s-sync",
+		Address:        "127.0.0.1",
+		NodeMeta: map[string]string{
+			ConsulSourceKey: ConsulSourceValue,
+		},
+	}
+	if t.ClusterName != "" {
+		r.Node = "k8s-sync-" + t.ClusterName
+		r.NodeMeta[ConsulK8SCluster] = t.ClusterName
+	}
+
+	return r
+}
+
 func (t *ServiceResource) prefixServiceName(name string) string {
 	if t.ConsulServicePrefix != "" {
 		return fmt.Sprintf("%s%s", t.ConsulServicePrefix, name)
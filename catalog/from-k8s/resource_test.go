@@ -5,10 +5,12 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul-k8s/helper/controller"
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -53,6 +55,37 @@ func TestServiceResource_createDelete(t *testing.T) {
 	require.Len(actual, 0)
 }
 
+// Test that the cluster name is added to the registrations.
+func TestServiceResource_clusterName(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:         hclog.Default(),
+		Client:      client,
+		Syncer:      syncer,
+		ClusterName: "east",
+	})
+	defer closer()
+
+	// Insert an LB service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(testService("foo"))
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("k8s-sync-east", actual[0].Node)
+	require.Equal("east", actual[0].NodeMeta[ConsulK8SCluster])
+	require.Equal("east", actual[0].Service.Meta[ConsulK8SCluster])
+}
+
 // Test that we're default enabled.
 func TestServiceResource_defaultEnable(t *testing.T) {
 	t.Parallel()
@@ -168,6 +201,37 @@ func TestServiceResource_defaultDisableEnable(t *testing.T) {
 	require.Len(actual, 1)
 }
 
+// Test that services created by the Consul to K8S sync are never synced
+// back, even if they are annotated to be synced.
+func TestServiceResource_syncedFromConsul(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:    hclog.Default(),
+		Client: client,
+		Syncer: syncer,
+	})
+	defer closer()
+
+	// Insert an LB service
+	svc := testService("foo")
+	svc.Labels = map[string]string{labelManagedBy: labelManagedByConsul}
+	svc.Annotations[annotationServiceSync] = "true"
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(svc)
+	require.NoError(err)
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 0)
+}
+
 // Test that system resources are not synced by default.
 func TestServiceResource_system(t *testing.T) {
 	t.Parallel()
@@ -196,6 +260,80 @@ func TestServiceResource_system(t *testing.T) {
 	require.Len(actual, 0)
 }
 
+// Test that only services in allowed namespaces are synced.
+func TestServiceResource_allowDenyNamespaces(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:                hclog.Default(),
+		Client:             client,
+		Syncer:             syncer,
+		AllowK8SNamespaces: []string{"team-*", metav1.NamespaceSystem},
+		DenyK8SNamespaces:  []string{"team-secret"},
+	})
+	defer closer()
+
+	// Insert LB services in several namespaces
+	namespaces := map[string]string{
+		"team-a":               "1.1.1.1",
+		"team-secret":          "2.2.2.2",
+		"other":                "3.3.3.3",
+		metav1.NamespaceSystem: "4.4.4.4",
+	}
+	for ns, ip := range namespaces {
+		svc := testService("foo")
+		svc.Status.LoadBalancer.Ingress[0].IP = ip
+		_, err := client.CoreV1().Services(ns).Create(svc)
+		require.NoError(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	addrs := []string{actual[0].Service.Address, actual[1].Service.Address}
+	require.ElementsMatch([]string{"1.1.1.1", "4.4.4.4"}, addrs)
+}
+
+// Test that only services matching the selector are synced.
+func TestServiceResource_serviceSelector(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Insert LB services before starting so they are loaded by the list
+	svc := testService("foo")
+	svc.Labels = map[string]string{"sync": "true"}
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(svc)
+	require.NoError(err)
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(testService("bar"))
+	require.NoError(err)
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:             hclog.Default(),
+		Client:          client,
+		Syncer:          syncer,
+		ServiceSelector: "sync=true",
+	})
+	defer closer()
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("foo", actual[0].Service.Service)
+}
+
 // Test that external IPs take priority.
 func TestServiceResource_externalIP(t *testing.T) {
 	t.Parallel()
@@ -521,6 +659,233 @@ func TestServiceResource_lbPort(t *testing.T) {
 	require.Equal("8500", actual[0].Service.Meta["port-rpc"])
 }
 
+// Test that checks defined by annotations are added to every instance.
+func TestServiceResource_customChecks(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:    hclog.Default(),
+		Client: client,
+		Syncer: syncer,
+	})
+	defer closer()
+
+	// Insert an LB service with checks
+	svc := testService("foo")
+	svc.Spec.Ports = []apiv1.ServicePort{
+		apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+	}
+	svc.Annotations[annotationServiceCheckHTTP] = "http://${address}:${port}/health"
+	svc.Annotations[annotationServiceCheckTCP] = "${address}:${port}"
+	svc.Annotations[annotationServiceCheckInterval] = "30s"
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(svc)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Len(actual[0].Checks, 2)
+
+	http := actual[0].Checks[0]
+	require.Equal(customCheckID(actual[0].Service.ID, "http"), http.CheckID)
+	require.Equal(actual[0].Service.ID, http.ServiceID)
+	require.Equal("http://1.2.3.4:80/health", http.Definition.HTTP)
+	require.Equal(consulapi.HealthPassing, http.Status)
+	require.Equal(30*time.Second, http.Definition.IntervalDuration)
+
+	tcp := actual[0].Checks[1]
+	require.Equal(customCheckID(actual[0].Service.ID, "tcp"), tcp.CheckID)
+	require.Equal("1.2.3.4:80", tcp.Definition.TCP)
+}
+
+// Test that the weights are set from annotations.
+func TestServiceResource_lbWeights(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:    hclog.Default(),
+		Client: client,
+		Syncer: syncer,
+	})
+	defer closer()
+
+	// Insert an LB service
+	svc := testService("foo")
+	svc.Annotations[annotationServiceWeightPassing] = "10"
+	svc.Annotations[annotationServiceWeightWarning] = "2"
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(svc)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal(consulapi.AgentWeights{Passing: 10, Warning: 2}, actual[0].Service.Weights)
+}
+
+// Test that the passing weight can be the number of ready endpoints.
+func TestServiceResource_lbWeightsEndpoints(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:    hclog.Default(),
+		Client: client,
+		Syncer: syncer,
+	})
+	defer closer()
+
+	// Insert an LB service
+	svc := testService("foo")
+	svc.Annotations[annotationServiceWeightPassing] = weightEndpoints
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(svc)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Without endpoints the weight is the lowest allowed
+	syncer.Lock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal(consulapi.AgentWeights{Passing: 1, Warning: 1}, actual[0].Service.Weights)
+	syncer.Unlock()
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "10.0.0.1"},
+					apiv1.EndpointAddress{IP: "10.0.0.2"},
+					apiv1.EndpointAddress{IP: "10.0.0.3"},
+				},
+				NotReadyAddresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "10.0.0.4"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual = syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Equal(consulapi.AgentWeights{Passing: 3, Warning: 1}, actual[0].Service.Weights)
+}
+
+// Test that endpoints listed in several subsets are counted once for the
+// passing weight, and that instances registered for each endpoint get a
+// weight of 1.
+func TestServiceResource_weightsEndpointsMultiPort(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+	})
+	defer closer()
+
+	// Insert an LB and a ClusterIP service
+	lb := testService("foo")
+	lb.Annotations[annotationServiceWeightPassing] = weightEndpoints
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(lb)
+	require.NoError(err)
+
+	clusterIP := testService("bar")
+	clusterIP.Spec.Type = apiv1.ServiceTypeClusterIP
+	clusterIP.Annotations[annotationServiceWeightPassing] = weightEndpoints
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(clusterIP)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Insert the endpoints, with a subset for each port of the same pods
+	podAddr := func(ip, uid string) apiv1.EndpointAddress {
+		return apiv1.EndpointAddress{
+			IP: ip,
+			TargetRef: &apiv1.ObjectReference{
+				Kind: "Pod",
+				Name: uid,
+				UID:  types.UID(uid),
+			},
+		}
+	}
+	for _, name := range []string{"foo", "bar"} {
+		_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+
+			Subsets: []apiv1.EndpointSubset{
+				apiv1.EndpointSubset{
+					Addresses: []apiv1.EndpointAddress{
+						podAddr("10.0.0.1", "pod1"),
+						podAddr("10.0.0.2", "pod2"),
+					},
+					Ports: []apiv1.EndpointPort{
+						apiv1.EndpointPort{Name: "http", Port: 8080},
+					},
+				},
+				apiv1.EndpointSubset{
+					Addresses: []apiv1.EndpointAddress{
+						podAddr("10.0.0.1", "pod1"),
+						podAddr("10.0.0.2", "pod2"),
+					},
+					Ports: []apiv1.EndpointPort{
+						apiv1.EndpointPort{Name: "rpc", Port: 8500},
+					},
+				},
+			},
+		})
+		require.NoError(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 3)
+	for _, r := range actual {
+		switch r.Service.Service {
+		case "foo":
+			require.Equal(consulapi.AgentWeights{Passing: 2, Warning: 1}, r.Service.Weights)
+		case "bar":
+			require.Equal(consulapi.AgentWeights{Passing: 1, Warning: 1}, r.Service.Weights)
+		default:
+			t.Fatalf("unexpected service: %s", r.Service.Service)
+		}
+	}
+}
+
 // Test default port works with override annotation
 func TestServiceResource_lbAnnotatedPort(t *testing.T) {
 	t.Parallel()
@@ -734,8 +1099,9 @@ func TestServiceResource_nodePort(t *testing.T) {
 	require.NotEqual(actual[0].Service.ID, actual[1].Service.ID)
 }
 
-// Test node port works with prefix
-func TestServiceResource_nodePortPrefix(t *testing.T) {
+// Test that NodePort instances are registered once their node is known and
+// updated when the addresses of the node change.
+func TestServiceResource_nodePortNodeUpdate(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 	client := fake.NewSimpleClientset()
@@ -743,28 +1109,119 @@ func TestServiceResource_nodePortPrefix(t *testing.T) {
 
 	// Start the controller
 	closer := controller.TestControllerRun(&ServiceResource{
-		Log:                 hclog.Default(),
-		Client:              client,
-		Syncer:              syncer,
-		NodePortSync:        ExternalOnly,
-		ConsulServicePrefix: "prefix",
+		Log:          hclog.Default(),
+		Client:       client,
+		Syncer:       syncer,
+		NodePortSync: ExternalOnly,
 	})
 	defer closer()
 
+	// Insert the endpoints and the service before the node
 	node1 := "ip-10-11-12-13.ec2.internal"
-	node2 := "ip-10-11-12-14.ec2.internal"
-	// Insert the nodes
-	_, err := client.CoreV1().Nodes().Create(&apiv1.Node{
+	_, err := client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: node1,
+			Name: "foo",
 		},
 
-		Status: apiv1.NodeStatus{
-			Addresses: []apiv1.NodeAddress{
-				apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "1.2.3.4"},
-				apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "4.5.6.7"},
-			},
-		},
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{NodeName: &node1, IP: "10.0.0.1"},
+				},
+				Ports: []apiv1.EndpointPort{
+					apiv1.EndpointPort{Name: "http", Port: 8080},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeNodePort,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080), NodePort: 30000},
+			},
+		},
+	})
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	syncer.Lock()
+	require.Len(syncer.Registrations, 0)
+	syncer.Unlock()
+
+	// Insert the node
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: node1,
+		},
+
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "1.2.3.4"},
+			},
+		},
+	}
+	_, err = client.CoreV1().Nodes().Create(node)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	syncer.Lock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Equal(30000, actual[0].Service.Port)
+	syncer.Unlock()
+
+	// Update the address of the node
+	node.Status.Addresses[0].Address = "5.6.7.8"
+	_, err = client.CoreV1().Nodes().Update(node)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual = syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("5.6.7.8", actual[0].Service.Address)
+}
+
+// Test node port works with prefix
+func TestServiceResource_nodePortPrefix(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:                 hclog.Default(),
+		Client:              client,
+		Syncer:              syncer,
+		NodePortSync:        ExternalOnly,
+		ConsulServicePrefix: "prefix",
+	})
+	defer closer()
+
+	node1 := "ip-10-11-12-13.ec2.internal"
+	node2 := "ip-10-11-12-14.ec2.internal"
+	// Insert the nodes
+	_, err := client.CoreV1().Nodes().Create(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: node1,
+		},
+
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "1.2.3.4"},
+				apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "4.5.6.7"},
+			},
+		},
 	})
 	require.NoError(err)
 
@@ -1600,6 +2057,182 @@ func TestServiceResource_clusterIP(t *testing.T) {
 	require.Equal("2.3.4.5", actual[1].Service.Address)
 	require.Equal(80, actual[1].Service.Port)
 	require.NotEqual(actual[0].Service.ID, actual[1].Service.ID)
+
+	// Nodes aren't watched since no instances need them
+	for _, action := range client.Actions() {
+		require.False(action.Matches("list", "nodes"), "nodes should not be listed")
+	}
+}
+
+// Test that the pod UID is used for the IDs of ClusterIP instances if
+// enabled, and the address is used for addresses that aren't pods.
+func TestServiceResource_clusterIPPodUID(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:               hclog.Default(),
+		Client:            client,
+		Syncer:            syncer,
+		ClusterIPSync:     true,
+		ServiceIDStrategy: ServiceIDPodUID,
+	})
+	defer closer()
+
+	// Insert the service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{
+						IP: "1.2.3.4",
+						TargetRef: &apiv1.ObjectReference{
+							Kind: "Pod",
+							Name: "foo-abc",
+							UID:  "a5a1b1e6-5d71-11e9-a9a6-0242ac110002",
+						},
+					},
+					apiv1.EndpointAddress{IP: "2.3.4.5"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Equal(serviceID("foo", "a5a1b1e6-5d71-11e9-a9a6-0242ac110002"), actual[0].Service.ID)
+	require.Equal("2.3.4.5", actual[1].Service.Address)
+	require.Equal(serviceID("foo", "2.3.4.5"), actual[1].Service.ID)
+}
+
+// Test that the meta of ClusterIP instances includes the pod and its
+// allowed labels, and is updated when the labels change.
+func TestServiceResource_clusterIPPodMeta(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+		PodLabels:     []string{"version", "app.kubernetes.io/part-of"},
+	})
+	defer closer()
+
+	// Insert the pod, service and endpoints
+	pod, err := client.CoreV1().Pods(metav1.NamespaceDefault).Create(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo-abc",
+			Labels: map[string]string{
+				"version":                   "v1",
+				"app.kubernetes.io/part-of": "shop",
+				"other":                     "ignored",
+			},
+		},
+	})
+	require.NoError(err)
+
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+	})
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	node := "k8s-node-1"
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{
+						IP:       "1.2.3.4",
+						NodeName: &node,
+						TargetRef: &apiv1.ObjectReference{
+							Kind:      "Pod",
+							Name:      "foo-abc",
+							Namespace: metav1.NamespaceDefault,
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	meta := actual[0].Service.Meta
+	syncer.Unlock()
+	require.Equal("foo-abc", meta[ConsulK8SPod])
+	require.Equal(metav1.NamespaceDefault, meta[ConsulK8SPodNS])
+	require.Equal(node, meta[ConsulK8SNode])
+	require.Equal("v1", meta["version"])
+	require.Equal("shop", meta["app_kubernetes_io_part-of"])
+	require.NotContains(meta, "other")
+
+	// Update the pod labels
+	pod.Labels["version"] = "v2"
+	_, err = client.CoreV1().Pods(metav1.NamespaceDefault).Update(pod)
+	require.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual = syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("v2", actual[0].Service.Meta["version"])
 }
 
 // Test clusterIP with prefix
@@ -2041,6 +2674,408 @@ func TestServiceResource_clusterIPAllNamespaces(t *testing.T) {
 	require.NotEqual(actual[0].Service.ID, actual[1].Service.ID)
 }
 
+// Test that not ready endpoints are registered with a critical check.
+func TestServiceResource_clusterIPNotReady(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+	})
+	defer closer()
+
+	// Insert the service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "1.2.3.4"},
+				},
+				NotReadyAddresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "2.3.4.5"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Len(actual[0].Checks, 1)
+	require.Equal(consulapi.HealthPassing, actual[0].Checks[0].Status)
+	require.Equal(actual[0].Service.ID, actual[0].Checks[0].ServiceID)
+	require.Equal("2.3.4.5", actual[1].Service.Address)
+	require.Len(actual[1].Checks, 1)
+	require.Equal(consulapi.HealthCritical, actual[1].Checks[0].Status)
+	require.Equal(actual[1].Service.ID, actual[1].Checks[0].ServiceID)
+	require.NotEqual(actual[0].Checks[0].CheckID, actual[1].Checks[0].CheckID)
+}
+
+// Test that instances are registered on their K8S node when enabled.
+func TestServiceResource_clusterIPSyncK8SNodes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+		SyncK8SNodes:  true,
+	})
+	defer closer()
+
+	node1 := "ip-10-11-12-13.ec2.internal"
+	node2 := "ip-10-11-12-14.ec2.internal"
+	_, err := client.CoreV1().Nodes().Create(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: node1,
+			Labels: map[string]string{
+				"kubernetes.io/hostname": node1,
+				"consul-reserved":        "true",
+			},
+		},
+
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "1.2.3.4"},
+				apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "4.5.6.7"},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Node without an internal IP
+	_, err = client.CoreV1().Nodes().Create(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: node2,
+		},
+
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "2.3.4.5"},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Insert the service
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{NodeName: &node1, IP: "10.0.0.1"},
+					apiv1.EndpointAddress{NodeName: &node2, IP: "10.0.0.2"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	require.Equal("10.0.0.1", actual[0].Service.Address)
+	require.Equal(node1, actual[0].Node)
+	require.Equal("4.5.6.7", actual[0].Address)
+	require.False(actual[0].SkipNodeUpdate)
+	require.Equal(map[string]string{
+		ConsulSourceKey:          ConsulSourceValue,
+		"kubernetes_io_hostname": node1,
+	}, actual[0].NodeMeta)
+	require.Equal(node1, actual[0].Checks[0].Node)
+	require.Equal("10.0.0.2", actual[1].Service.Address)
+	require.Equal("k8s-sync", actual[1].Node)
+	require.Equal("127.0.0.1", actual[1].Address)
+}
+
+// Test that headless services use the pod hostname and subdomain when
+// available.
+func TestServiceResource_headless(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+	})
+	defer closer()
+
+	// Insert the service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: metav1.NamespaceDefault,
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type:      apiv1.ServiceTypeClusterIP,
+			ClusterIP: apiv1.ClusterIPNone,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 5432, TargetPort: intstr.FromInt(5432)},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Insert the pods, the subdomain can be another headless service
+	for _, pod := range []*apiv1.Pod{
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-0"},
+			Spec:       apiv1.PodSpec{Hostname: "foo-0", Subdomain: "db"},
+		},
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-1"},
+			Spec:       apiv1.PodSpec{Hostname: "foo-1"},
+		},
+	} {
+		_, err = client.CoreV1().Pods(metav1.NamespaceDefault).Create(pod)
+		require.NoError(err)
+	}
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	podRef := func(name string) *apiv1.ObjectReference {
+		return &apiv1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: metav1.NamespaceDefault,
+			Name:      name,
+		}
+	}
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "1.2.3.4", Hostname: "foo-0", TargetRef: podRef("foo-0")},
+					apiv1.EndpointAddress{IP: "2.3.4.5", Hostname: "foo-1", TargetRef: podRef("foo-1")},
+					apiv1.EndpointAddress{IP: "3.4.5.6"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 3)
+	require.Equal("foo", actual[0].Service.Service)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Equal(5432, actual[0].Service.Port)
+	require.Equal(serviceID("foo", "foo-0.db.default.svc"), actual[0].Service.ID)
+	require.Equal("foo-0.db.default.svc", actual[0].Service.Meta[ConsulK8SHostname])
+
+	// Pods without a subdomain have no DNS name
+	require.Equal("2.3.4.5", actual[1].Service.Address)
+	require.Equal(serviceID("foo", "2.3.4.5"), actual[1].Service.ID)
+	require.NotContains(actual[1].Service.Meta, ConsulK8SHostname)
+	require.Equal("3.4.5.6", actual[2].Service.Address)
+	require.Equal(serviceID("foo", "3.4.5.6"), actual[2].Service.ID)
+	require.NotContains(actual[2].Service.Meta, ConsulK8SHostname)
+}
+
+// Test that ExternalName services are registered with the DNS name.
+func TestServiceResource_externalName(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:    hclog.Default(),
+		Client: client,
+		Syncer: syncer,
+	})
+	defer closer()
+
+	// Insert the service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type:         apiv1.ServiceTypeExternalName,
+			ExternalName: "db.example.com.",
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Port: 5432},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 1)
+	require.Equal("foo", actual[0].Service.Service)
+	require.Equal("db.example.com", actual[0].Service.Address)
+	require.Equal(5432, actual[0].Service.Port)
+	require.Equal("k8s-sync", actual[0].Node)
+	require.Equal("127.0.0.1", actual[0].Address)
+}
+
+// Test that each port is registered as its own service if annotated.
+func TestServiceResource_clusterIPMultiPort(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	client := fake.NewSimpleClientset()
+	syncer := &TestSyncer{}
+
+	// Start the controller
+	closer := controller.TestControllerRun(&ServiceResource{
+		Log:           hclog.Default(),
+		Client:        client,
+		Syncer:        syncer,
+		ClusterIPSync: true,
+		ConsulK8STag:  TestConsulK8STag,
+	})
+	defer closer()
+
+	// Insert the service
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Annotations: map[string]string{annotationServiceMultiPort: "true"},
+		},
+
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{Name: "grpc", Port: 80, TargetPort: intstr.FromInt(8080)},
+				apiv1.ServicePort{Name: "metrics", Port: 9102, Protocol: apiv1.ProtocolUDP},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Insert the endpoints
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+		},
+
+		Subsets: []apiv1.EndpointSubset{
+			apiv1.EndpointSubset{
+				Addresses: []apiv1.EndpointAddress{
+					apiv1.EndpointAddress{IP: "1.2.3.4"},
+				},
+			},
+		},
+	})
+	require.NoError(err)
+
+	// Wait a bit
+	time.Sleep(300 * time.Millisecond)
+
+	// Verify what we got
+	syncer.Lock()
+	defer syncer.Unlock()
+	actual := syncer.Registrations
+	require.Len(actual, 2)
+	require.Equal("foo-grpc", actual[0].Service.Service)
+	require.Equal("1.2.3.4", actual[0].Service.Address)
+	require.Equal(80, actual[0].Service.Port)
+	require.Equal([]string{"k8s", "tcp"}, actual[0].Service.Tags)
+	require.Len(actual[0].Checks, 1)
+	require.Equal(actual[0].Service.ID, actual[0].Checks[0].ServiceID)
+	require.Equal(readinessCheckID(actual[0].Service.ID), actual[0].Checks[0].CheckID)
+	require.Equal("foo-metrics", actual[1].Service.Service)
+	require.Equal("1.2.3.4", actual[1].Service.Address)
+	require.Equal(9102, actual[1].Service.Port)
+	require.Equal([]string{"k8s", "udp"}, actual[1].Service.Tags)
+	require.NotEqual(actual[0].Service.ID, actual[1].Service.ID)
+}
+
 // testService returns a service that will result in a registration.
 func testService(name string) *apiv1.Service {
 	return &apiv1.Service{
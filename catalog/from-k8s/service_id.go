@@ -15,3 +15,17 @@ func serviceID(name, addr string) string {
 	sum := sha1.Sum([]byte(fmt.Sprintf("%s-%s", name, addr)))
 	return fmt.Sprintf("%s-%s", name, hex.EncodeToString(sum[:])[:12])
 }
+
+// readinessCheckID generates the ID of the readiness check for the
+// service instance with the given ID. Check IDs must be unique per node
+// so this is derived from the already unique service ID. Check IDs must
+// always be prefixed with the service ID.
+func readinessCheckID(serviceID string) string {
+	return fmt.Sprintf("%s/kubernetes-readiness", serviceID)
+}
+
+// customCheckID generates the ID of the check of the given type that is
+// defined by annotations for the service instance with the given ID.
+func customCheckID(serviceID, checkType string) string {
+	return fmt.Sprintf("%s/%s", serviceID, checkType)
+}
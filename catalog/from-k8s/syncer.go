@@ -2,12 +2,21 @@ package catalog
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/hashicorp/consul-k8s/helper/coalesce"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -15,9 +24,13 @@ const (
 	// reconcile the expected service states with the remote Consul server.
 	ConsulSyncPeriod = 30 * time.Second
 
-	// ConsulServicePollPeriod is how often a service is checked for
-	// whether it has instances to reap.
-	ConsulServicePollPeriod = 60 * time.Second
+	// ConsulSyncQuietPeriod is the time to wait for no changes before
+	// writing them to Consul.
+	ConsulSyncQuietPeriod = 500 * time.Millisecond
+
+	// ConsulSyncMaxPeriod is the maximum time to wait before writing
+	// changes to Consul, even if there are active changes going on.
+	ConsulSyncMaxPeriod = 5 * time.Second
 )
 
 // Syncer is responsible for syncing a set of Consul catalog registrations.
@@ -48,26 +61,56 @@ type ConsulSyncer struct {
 
 	// SyncPeriod is the interval between full catalog syncs. These will
 	// re-register all services to prevent overwrites of data. This should
-	// happen relatively infrequently and default to 30 seconds.
-	//
-	// ServicePollPeriod is the interval to look for invalid services to
-	// deregister. One request will be made for each synced service in
-	// Kubernetes.
+	// happen relatively infrequently and default to 30 seconds. Changes
+	// given to Sync are written as soon as possible without waiting for
+	// a full sync.
 	//
-	// For both syncs, smaller more frequent and focused syncs may be
-	// triggered by known drift or changes.
+	// ServicePollPeriod is the minimum interval between checks of the
+	// services registered from Kubernetes for instances to deregister or
+	// re-register. Checks are triggered by a single blocking query for
+	// changes to the services, and the services of every node from
+	// Kubernetes are fetched with a single request. This defaults to a
+	// quarter of SyncPeriod.
 	SyncPeriod        time.Duration
 	ServicePollPeriod time.Duration
 
 	// ConsulK8STag is the tag value for services registered.
 	ConsulK8STag string
 
-	lock     sync.Mutex
-	once     sync.Once
-	services map[string]struct{} // set of valid service names
-	nodes    map[string]*consulSyncState
-	deregs   map[string]*api.CatalogDeregistration
-	watchers map[string]context.CancelFunc
+	// ClusterName is the name of the Kubernetes cluster the registrations
+	// are from. The syncer only reaps services and nodes whose cluster meta
+	// is equal to this, so that multiple clusters can sync into the same
+	// Consul datacenter. If this is blank, only services and nodes with no
+	// cluster meta are reaped. Services registered before this was set have
+	// no cluster meta, so they are never reaped once it is set.
+	ClusterName string
+
+	// UseTxn, if true, writes registrations and deregistrations in batches
+	// using the Consul transaction API rather than making a request for each
+	// service instance. This requires Consul 1.4 or later.
+	UseTxn bool
+
+	// EventRecorder, if set, records events on the Kubernetes services
+	// whose registrations fail, so they are visible in Kubernetes.
+	EventRecorder record.EventRecorder
+
+	// DryRun, if true, only logs the registrations and deregistrations that
+	// would be written without writing anything to Consul. They are then
+	// treated as written so that only changes are logged.
+	DryRun bool
+
+	lock   sync.Mutex
+	once   sync.Once
+	nodes  map[string]*consulSyncState
+	deregs map[string]*api.CatalogDeregistration // keyed by deregKey
+
+	// written is the last registration successfully written to Consul
+	// for every service instance, keyed by deregKey. This is used to only
+	// write changed registrations and to deregister removed instances.
+	written map[string]*api.CatalogRegistration
+
+	// triggerCh is notified when there are changes to write.
+	triggerCh chan struct{}
 }
 
 // consulSyncState keeps track of the state of syncing nodes/services.
@@ -78,16 +121,14 @@ type consulSyncState struct {
 
 // Sync implements Syncer
 func (s *ConsulSyncer) Sync(rs []*api.CatalogRegistration) {
+	s.once.Do(s.init)
+
 	// Grab the lock so we can replace the sync state
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.services = make(map[string]struct{})
 	s.nodes = make(map[string]*consulSyncState)
 	for _, r := range rs {
-		// Mark this as a valid service
-		s.services[r.Service.Service] = struct{}{}
-
 		// Initialize the state if we don't have it
 		state, ok := s.nodes[r.Node]
 		if !ok {
@@ -101,6 +142,9 @@ func (s *ConsulSyncer) Sync(rs []*api.CatalogRegistration) {
 		// Add our registration
 		state.Services[r.Service.ID] = r
 	}
+
+	// Write the changes to Consul
+	s.trigger()
 }
 
 // Run is the long-running runloop for reconciling the local set of
@@ -108,7 +152,7 @@ func (s *ConsulSyncer) Sync(rs []*api.CatalogRegistration) {
 func (s *ConsulSyncer) Run(ctx context.Context) {
 	s.once.Do(s.init)
 
-	// Start the background watchers
+	// Start the background watcher
 	go s.watchReapableServices(ctx)
 
 	reconcileTimer := time.NewTimer(s.SyncPeriod)
@@ -120,6 +164,22 @@ func (s *ConsulSyncer) Run(ctx context.Context) {
 			s.Log.Info("ConsulSyncer quitting")
 			return
 
+		case <-s.triggerCh:
+			// Coalesce to prevent lots of API calls during churn periods.
+			coalesce.Coalesce(ctx,
+				ConsulSyncQuietPeriod, ConsulSyncMaxPeriod,
+				func(ctx context.Context) {
+					select {
+					case <-s.triggerCh:
+					case <-ctx.Done():
+					}
+				})
+			if ctx.Err() != nil {
+				continue
+			}
+
+			s.syncChanges(ctx)
+
 		case <-reconcileTimer.C:
 			s.syncFull(ctx)
 			reconcileTimer.Reset(s.SyncPeriod)
@@ -128,31 +188,38 @@ func (s *ConsulSyncer) Run(ctx context.Context) {
 }
 
 // watchReapableServices is a long-running task started by Run that
-// holds blocking queries to the Consul server to watch for any services
-// tagged with k8s that are no longer valid and need to be deleted.
-// This task only marks them for deletion but doesn't perform the actual
-// deletion.
+// holds blocking queries to the Consul server to watch for changes to the
+// services registered from K8S. On every change, the nodes registered from
+// K8S are checked for service instances and nodes that are no longer valid
+// and need to be deleted, and for valid service instances that are missing
+// and need to be registered again. This task only marks them but doesn't
+// perform the actual writes.
 func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
 	opts := api.QueryOptions{
 		AllowStale: true,
 		WaitIndex:  1,
 		WaitTime:   1 * time.Minute,
+		NodeMeta:   s.nodeMeta(),
 	}
 
-	// minWait is the minimum time to wait between scheduling service deletes.
-	// This prevents a lot of churn in services causing high CPU usage.
-	minWait := s.SyncPeriod / 4
+	// minWaitCh enforces the minimum time between checks. This prevents a
+	// lot of churn in services causing high CPU usage.
 	minWaitCh := time.After(0)
 	for {
-		// Get all services with tags.
-		var serviceMap map[string][]string
+		// Wait for changes to the services. Only the index is used since
+		// the services of every node are checked.
 		var meta *api.QueryMeta
 		err := backoff.Retry(func() error {
 			var err error
-			serviceMap, meta, err = s.Client.Catalog().Services(&opts)
+			_, meta, err = s.Client.Catalog().Services(&opts)
 			return err
 		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			metricAPIErrors.WithLabelValues("query").Inc()
 			s.Log.Warn("error querying services, will retry", "err", err)
 			continue
 		}
@@ -160,11 +227,7 @@ func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
 		// Wait our minimum time before continuing or retrying
 		select {
 		case <-minWaitCh:
-			if err != nil {
-				continue
-			}
-
-			minWaitCh = time.After(minWait)
+			minWaitCh = time.After(s.ServicePollPeriod)
 		case <-ctx.Done():
 			return
 		}
@@ -172,209 +235,609 @@ func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
 		// Update our blocking index
 		opts.WaitIndex = meta.LastIndex
 
-		// Lock so we can modify the
+		// Copy the written registrations before querying the nodes so that
+		// registrations written during the queries aren't considered missing.
 		s.lock.Lock()
+		written := make(map[string]*api.CatalogRegistration, len(s.written))
+		for k, r := range s.written {
+			written[k] = r
+		}
+		s.lock.Unlock()
 
-		// Go through the service map and find services that should be reaped
-		for name, tags := range serviceMap {
-			for _, tag := range tags {
-				if tag == s.ConsulK8STag {
-					// We only care if we don't know about this service at all.
-					if _, ok := s.services[name]; ok {
-						continue
-					}
-
-					s.Log.Info("invalid service found, scheduling for delete",
-						"service-name", name)
-					if err := s.scheduleReapServiceLocked(name); err != nil {
-						s.Log.Info("error querying service for delete",
-							"service-name", name,
-							"err", err)
-					}
-
-					// We're done searching this service, let it go
-					break
-				}
-			}
+		// Query the nodes without holding the lock so that syncs, and the
+		// informers that wait on them, aren't blocked on the requests.
+		nodes, err := s.queryNodes()
+		if err != nil {
+			metricAPIErrors.WithLabelValues("query").Inc()
+			s.Log.Info("error querying nodes for delete", "err", err)
+			continue
 		}
 
+		// Lock so we can modify the set of actions to take
+		s.lock.Lock()
+		changed := s.scheduleReapNodesLocked(nodes, written)
+		if changed || len(s.deregs) > 0 {
+			s.trigger()
+		}
 		s.lock.Unlock()
 	}
 }
 
-// watchService watches all instances of a service by name for changes
-// and schedules re-registration or deletion if necessary.
-func (s *ConsulSyncer) watchService(ctx context.Context, name string) {
-	s.Log.Info("starting service watcher", "service-name", name)
-	defer s.Log.Info("stopping service watcher", "service-name", name)
+// queryNodes returns the nodes registered from K8S by this syncer's
+// cluster along with their services. These are fetched with a single
+// request to the node dump used by the Consul UI, filtered by the node
+// meta, so that the number of requests doesn't grow with the number of
+// nodes or services. Consul versions before 1.5 ignore the filter, so the
+// node meta is also checked here. The lock must not be held.
+func (s *ConsulSyncer) queryNodes() ([]*api.CatalogNode, error) {
+	meta := s.nodeMeta()
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	for {
-		select {
-		// Quit if our context is over
-		case <-ctx.Done():
-			return
+	filters := make([]string, 0, len(keys))
+	for _, k := range keys {
+		filters = append(filters, fmt.Sprintf("Meta[%q] == %q", k, meta[k]))
+	}
 
-		// Wait for our poll period
-		case <-time.After(s.SyncPeriod):
+	var dump []*struct {
+		Node     string
+		Address  string
+		Meta     map[string]string
+		Services []*api.AgentService
+	}
+	_, err := s.Client.Raw().Query("/v1/internal/ui/nodes", &dump, &api.QueryOptions{
+		AllowStale: true,
+		Filter:     strings.Join(filters, " and "),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*api.CatalogNode, 0, len(dump))
+	for _, info := range dump {
+		matched := true
+		for k, v := range meta {
+			if info.Meta[k] != v {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
 		}
 
-		// Wait for service changes
-		var services []*api.CatalogService
-		err := backoff.Retry(func() error {
-			var err error
-			services, _, err = s.Client.Catalog().Service(name, s.ConsulK8STag, &api.QueryOptions{
-				AllowStale: true,
-			})
-			return err
-		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
-		if err != nil {
-			s.Log.Warn("error querying service, will retry",
-				"service-name", name,
-				"err", err)
+		node := &api.CatalogNode{
+			Node: &api.Node{
+				Node:    info.Node,
+				Address: info.Address,
+				Meta:    info.Meta,
+			},
+			Services: make(map[string]*api.AgentService, len(info.Services)),
+		}
+		for _, svc := range info.Services {
+			node.Services[svc.ID] = svc
+		}
+		result = append(result, node)
+	}
+
+	return result, nil
+}
+
+// scheduleReapNodesLocked goes through the given nodes registered from K8S
+// and schedules the removal of the service instances with the k8s tag that
+// we no longer know about. Nodes are only removed once they have no
+// services left at all since they may be shared with other syncers, for
+// example syncers running for other namespaces. Valid service instances
+// that were written, according to the given copy of the written
+// registrations from before the nodes were queried, but are missing are
+// forgotten so that they are registered again, in which case this returns
+// true.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) scheduleReapNodesLocked(nodes []*api.CatalogNode, written map[string]*api.CatalogRegistration) bool {
+	// registered is the set of service instances found, by deregKey
+	registered := make(map[string]struct{})
+	for _, catalogNode := range nodes {
+		node := catalogNode.Node
+		if len(catalogNode.Services) == 0 {
+			// We only delete the node if we don't know about it at all
+			// and it is from our cluster.
+			_, ok := s.nodes[node.Node]
+			if !ok && node.Meta[ConsulK8SCluster] == s.ClusterName {
+				s.Log.Info("invalid node found, scheduling for delete",
+					"node-name", node.Node)
+				s.deregs[deregKey(node.Node, "")] = &api.CatalogDeregistration{
+					Node: node.Node,
+				}
+			}
+
 			continue
 		}
 
-		// Lock so we can modify the set of actions to take
-		s.lock.Lock()
+		for _, svc := range catalogNode.Services {
+			if !containsString(svc.Tags, s.ConsulK8STag) {
+				continue
+			}
 
-		for _, svc := range services {
 			// If we have a namespace set and the key exactly matches this
 			// namespace, then we skip it.
 			if s.Namespace != "" &&
-				len(svc.ServiceMeta) > 0 &&
-				svc.ServiceMeta[ConsulK8SNS] != "" &&
-				svc.ServiceMeta[ConsulK8SNS] != s.Namespace {
+				len(svc.Meta) > 0 &&
+				svc.Meta[ConsulK8SNS] != "" &&
+				svc.Meta[ConsulK8SNS] != s.Namespace {
 				continue
 			}
 
-			// We delete unless we have a service and the node mapping
-			delete := true
-			if _, ok := s.services[svc.ServiceName]; ok {
-				nodeSvc := s.nodes[svc.Node]
-				delete = nodeSvc == nil || nodeSvc.Services[svc.ServiceID] == nil
+			// Skip services from other clusters
+			if svc.Meta[ConsulK8SCluster] != s.ClusterName {
+				continue
 			}
 
-			if delete {
-				s.deregs[svc.ServiceID] = &api.CatalogDeregistration{
-					Node:      svc.Node,
-					ServiceID: svc.ServiceID,
-				}
+			k := deregKey(node.Node, svc.ID)
+			registered[k] = struct{}{}
+			if s.registrationLocked(node.Node, svc.ID) != nil {
+				continue
 			}
-		}
 
-		s.lock.Unlock()
+			s.Log.Info("invalid service found, scheduling for delete",
+				"node-name", node.Node,
+				"service-id", svc.ID)
+			s.deregs[k] = &api.CatalogDeregistration{
+				Node:      node.Node,
+				ServiceID: svc.ID,
+			}
+		}
 	}
-}
 
-// scheduleReapService finds all the instances of the service with the given
-// name that have the k8s tag and schedules them for removal.
-//
-// Precondition: lock must be held
-func (s *ConsulSyncer) scheduleReapServiceLocked(name string) error {
-	services, _, err := s.Client.Catalog().Service(name, s.ConsulK8STag, &api.QueryOptions{
-		AllowStale: true,
-	})
-	if err != nil {
-		return err
+	// Forget the written registrations that are missing, for example
+	// because they were deleted outside of the syncer. Nothing is written
+	// in a dry run so they are always missing.
+	changed := false
+	if s.DryRun {
+		return changed
 	}
-
-	for _, svc := range services {
-		// If we have a namespace set and the key exactly matches this
-		// namespace, then we skip it.
-		if s.Namespace != "" &&
-			len(svc.ServiceMeta) > 0 &&
-			svc.ServiceMeta[ConsulK8SNS] != "" &&
-			svc.ServiceMeta[ConsulK8SNS] != s.Namespace {
+	for k, r := range written {
+		if _, ok := registered[k]; ok {
 			continue
 		}
 
-		s.deregs[svc.ServiceID] = &api.CatalogDeregistration{
-			Node:      svc.Node,
-			ServiceID: svc.ServiceID,
+		// Skip the registrations that were written again or removed
+		// while the nodes were queried.
+		if s.written[k] != r {
+			continue
 		}
+
+		s.Log.Info("missing service found, scheduling for register",
+			"node-name", r.Node,
+			"service-id", r.Service.ID)
+		delete(s.written, k)
+		changed = true
 	}
 
-	return nil
+	return changed
 }
 
 // syncFull is called periodically to perform all the write-based API
-// calls to sync the data with Consul. This may also start background
-// watchers for specific services.
+// calls to sync the data with Consul. This re-registers every service
+// instance, overwriting any external changes.
 func (s *ConsulSyncer) syncFull(ctx context.Context) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	s.Log.Info("registering services")
+	start := time.Now()
+	defer func() {
+		metricSyncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	s.syncLocked(ctx, true)
+}
+
+// syncChanges writes the registrations that changed since they were last
+// written to Consul and the pending deregistrations.
+func (s *ConsulSyncer) syncChanges(ctx context.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	// Start the service watchers
-	for k, cf := range s.watchers {
-		if _, ok := s.services[k]; !ok {
-			cf()
-			delete(s.watchers, k)
+	s.Log.Debug("registering changed services")
+	s.syncLocked(ctx, false)
+}
+
+// syncLocked performs the deregistrations and registrations to sync the
+// data with Consul. If full is false, only registrations that differ from
+// the last written registration are written.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) syncLocked(ctx context.Context, full bool) {
+	// Deregister the instances we wrote that are no longer valid
+	for k, r := range s.written {
+		if s.registrationLocked(r.Node, r.Service.ID) == nil {
+			s.deregs[k] = &api.CatalogDeregistration{
+				Node:      r.Node,
+				ServiceID: r.Service.ID,
+			}
 		}
 	}
-	for k := range s.services {
-		if _, ok := s.watchers[k]; !ok {
-			svcCtx, cancelF := context.WithCancel(ctx)
-			go s.watchService(svcCtx, k)
-			s.watchers[k] = cancelF
+
+	// Determine the services that changed, or all of them if this is a
+	// full sync. A dry run only logs the changes.
+	regs := make(map[string]*api.CatalogRegistration)
+	for _, state := range s.nodes {
+		for _, r := range state.Services {
+			k := deregKey(r.Node, r.Service.ID)
+			if (!full || s.DryRun) && reflect.DeepEqual(s.written[k], r) {
+				continue
+			}
+
+			regs[k] = r
+		}
+	}
+
+	// Deregister the checks that were removed from the registrations
+	// since they were written, since registering only adds or updates
+	// checks.
+	for k, r := range regs {
+		written, ok := s.written[k]
+		if !ok {
+			continue
+		}
+
+		current := checkIDs(r)
+		for id := range checkIDs(written) {
+			if _, ok := current[id]; !ok {
+				s.deregs[deregKey(r.Node, id)] = &api.CatalogDeregistration{
+					Node:    r.Node,
+					CheckID: id,
+				}
+			}
 		}
 	}
 
 	// Do all deregistrations first
-	for _, r := range s.deregs {
-		s.Log.Info("deregistering service",
-			"node-name", r.Node,
-			"service-id", r.ServiceID)
-		_, err := s.Client.Catalog().Deregister(r, nil)
-		if err != nil {
+	errs := s.deregister(ctx, s.deregs)
+	for k, r := range s.deregs {
+		if err, ok := errs[k]; ok {
+			metricAPIErrors.WithLabelValues("deregister").Inc()
 			s.Log.Warn("error deregistering service",
 				"node-name", r.Node,
 				"service-id", r.ServiceID,
+				"check-id", r.CheckID,
 				"err", err)
+			continue
 		}
+
+		metricDeregistrations.Inc()
+		s.forgetWrittenLocked(k, r)
 	}
 
 	// Always clear deregistrations, they'll repopulate if we had errors
 	s.deregs = make(map[string]*api.CatalogDeregistration)
 
-	// Register all the services. This will overwrite any changes that
-	// may have been made to the registered services.
-	for _, state := range s.nodes {
-		for _, r := range state.Services {
-			_, err := s.Client.Catalog().Register(r, nil)
-			if err != nil {
-				s.Log.Warn("error registering service",
+	// Register the services. This will overwrite any changes that may have
+	// been made to the registered services.
+	errs = s.register(ctx, s.withCheckStatus(regs))
+	for k, r := range regs {
+		if err, ok := errs[k]; ok {
+			metricAPIErrors.WithLabelValues("register").Inc()
+			s.Log.Warn("error registering service",
+				"node-name", r.Node,
+				"service-name", r.Service.Service,
+				"err", err)
+			s.recordEvent(r, apiv1.EventTypeWarning, "RegisterFailed",
+				"failed to register in Consul: %s", err)
+			delete(s.written, k)
+			continue
+		}
+
+		s.Log.Debug("registered service instance",
+			"node-name", r.Node,
+			"service-name", r.Service.Service)
+		s.written[k] = r
+	}
+
+	metricRegisteredInstances.Set(float64(len(s.written)))
+}
+
+// withCheckStatus returns the given registrations with the current status
+// of their checks that have a definition, such as the checks defined by
+// annotations. These checks are run outside of the sync by consul-esm so
+// registering them again must not reset their status. The given
+// registrations aren't modified.
+func (s *ConsulSyncer) withCheckStatus(regs map[string]*api.CatalogRegistration) map[string]*api.CatalogRegistration {
+	if s.DryRun {
+		return regs
+	}
+
+	defined := false
+	for _, r := range regs {
+		if hasCheckDefinition(r) {
+			defined = true
+			break
+		}
+	}
+	if !defined {
+		return regs
+	}
+
+	current, err := s.queryFailingChecks()
+	if err != nil {
+		s.Log.Warn("error querying checks, check statuses may be reset", "err", err)
+	}
+
+	result := make(map[string]*api.CatalogRegistration, len(regs))
+	for k, r := range regs {
+		result[k] = r
+		if !hasCheckDefinition(r) {
+			continue
+		}
+
+		copied := *r
+		copied.Checks = make(api.HealthChecks, len(r.Checks))
+		for i, c := range r.Checks {
+			copied.Checks[i] = c
+			existing, ok := current[deregKey(r.Node, c.CheckID)]
+			if ok && isDefinedCheck(c) {
+				check := *c
+				check.Status = existing.Status
+				check.Output = existing.Output
+				copied.Checks[i] = &check
+			}
+		}
+		result[k] = &copied
+	}
+
+	return result
+}
+
+// queryFailingChecks returns the checks on the nodes registered from K8S
+// by this syncer's cluster that are warning or critical, keyed by deregKey.
+// Checks with a definition are registered as passing, so only the checks
+// with another status need to be looked up.
+func (s *ConsulSyncer) queryFailingChecks() (map[string]*api.HealthCheck, error) {
+	opts := &api.QueryOptions{
+		AllowStale: true,
+		NodeMeta:   s.nodeMeta(),
+	}
+
+	result := make(map[string]*api.HealthCheck)
+	for _, state := range []string{api.HealthWarning, api.HealthCritical} {
+		checks, _, err := s.Client.Health().State(state, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range checks {
+			result[deregKey(c.Node, c.CheckID)] = c
+		}
+	}
+
+	return result, nil
+}
+
+// checkIDs returns the set of the IDs of the checks of the given
+// registration.
+func checkIDs(r *api.CatalogRegistration) map[string]struct{} {
+	result := make(map[string]struct{}, len(r.Checks)+1)
+	if r.Check != nil {
+		result[r.Check.CheckID] = struct{}{}
+	}
+	for _, c := range r.Checks {
+		result[c.CheckID] = struct{}{}
+	}
+
+	return result
+}
+
+// hasCheckDefinition returns true if the given registration has a check
+// with an HTTP or TCP definition.
+func hasCheckDefinition(r *api.CatalogRegistration) bool {
+	for _, c := range r.Checks {
+		if isDefinedCheck(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDefinedCheck returns true if the given check has an HTTP or TCP
+// definition.
+func isDefinedCheck(c *api.HealthCheck) bool {
+	return c.Definition.HTTP != "" || c.Definition.TCP != ""
+}
+
+// register writes the given registrations to Consul and returns the
+// errors of those that failed, by key.
+func (s *ConsulSyncer) register(ctx context.Context, regs map[string]*api.CatalogRegistration) map[string]error {
+	if s.DryRun {
+		for _, r := range regs {
+			s.Log.Info("dry run: would register service",
+				"node-name", r.Node,
+				"service-name", r.Service.Service,
+				"service-id", r.Service.ID,
+				"registration", planJSON(r))
+		}
+
+		return nil
+	}
+
+	if s.UseTxn {
+		return s.registerTxn(ctx, regs)
+	}
+
+	errs := make(map[string]error)
+	for k, r := range regs {
+		if _, err := s.Client.Catalog().Register(r, nil); err != nil {
+			errs[k] = err
+		}
+	}
+
+	return errs
+}
+
+// deregister removes the given deregistrations from Consul and returns
+// the errors of those that failed, by key.
+func (s *ConsulSyncer) deregister(ctx context.Context, deregs map[string]*api.CatalogDeregistration) map[string]error {
+	if s.DryRun {
+		for _, r := range deregs {
+			if r.CheckID != "" {
+				s.Log.Info("dry run: would deregister check",
 					"node-name", r.Node,
-					"service-name", r.Service.Service,
-					"err", err)
+					"check-id", r.CheckID)
 				continue
 			}
 
-			s.Log.Debug("registered service instance",
+			s.Log.Info("dry run: would deregister service",
 				"node-name", r.Node,
-				"service-name", r.Service.Service)
+				"service-id", r.ServiceID)
 		}
+
+		return nil
 	}
+
+	for _, r := range deregs {
+		if r.CheckID != "" {
+			s.Log.Info("deregistering check",
+				"node-name", r.Node,
+				"check-id", r.CheckID)
+			continue
+		}
+
+		s.Log.Info("deregistering service",
+			"node-name", r.Node,
+			"service-id", r.ServiceID)
+	}
+
+	if s.UseTxn {
+		return s.deregisterTxn(ctx, deregs)
+	}
+
+	errs := make(map[string]error)
+	for k, r := range deregs {
+		if _, err := s.Client.Catalog().Deregister(r, nil); err != nil {
+			errs[k] = err
+		}
+	}
+
+	return errs
 }
 
-func (s *ConsulSyncer) init() {
-	if s.services == nil {
-		s.services = make(map[string]struct{})
+// registrationLocked returns the valid registration of the service
+// instance with the given ID on the given node, or nil if there is none.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) registrationLocked(node, serviceID string) *api.CatalogRegistration {
+	state, ok := s.nodes[node]
+	if !ok {
+		return nil
+	}
+
+	return state.Services[serviceID]
+}
+
+// forgetWrittenLocked removes the written registrations that were removed
+// from Consul by the given deregistration with the given key.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) forgetWrittenLocked(key string, r *api.CatalogDeregistration) {
+	if r.ServiceID != "" {
+		delete(s.written, key)
+		return
 	}
+
+	// Deregistering a check leaves its service registered
+	if r.CheckID != "" {
+		return
+	}
+
+	// Deregistering a node removes all of its services
+	for k, w := range s.written {
+		if w.Node == r.Node {
+			delete(s.written, k)
+		}
+	}
+}
+
+// nodeMeta returns the node meta of the nodes registered from K8S by
+// this syncer's cluster.
+func (s *ConsulSyncer) nodeMeta() map[string]string {
+	meta := map[string]string{ConsulSourceKey: ConsulSourceValue}
+	if s.ClusterName != "" {
+		meta[ConsulK8SCluster] = s.ClusterName
+	}
+
+	return meta
+}
+
+// trigger notifies Run that there are changes to write. This doesn't
+// block: if a write is already pending then the changes are included.
+func (s *ConsulSyncer) trigger() {
+	select {
+	case s.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// recordEvent records an event on the Kubernetes service the given
+// registration was generated from, if known.
+func (s *ConsulSyncer) recordEvent(r *api.CatalogRegistration, eventType, reason, messageFmt string, args ...interface{}) {
+	if s.EventRecorder == nil || r.Service == nil {
+		return
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(r.Service.Meta[ConsulK8SService])
+	if err != nil || name == "" {
+		return
+	}
+
+	s.EventRecorder.Eventf(&apiv1.ObjectReference{
+		Kind:      "Service",
+		Namespace: namespace,
+		Name:      name,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// planJSON returns the JSON encoding of the given value for logging the
+// plan of a dry run.
+func planJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+
+	return string(b)
+}
+
+// deregKey returns the key used to track the deregistration of the
+// service with the given ID on the given node. The service ID should be
+// empty to deregister the entire node. Service IDs are only unique per
+// node so the key must include both. This is also used with check IDs to
+// deregister checks, which never collide with service IDs since check IDs
+// are prefixed with the service ID and a slash.
+func deregKey(node, serviceID string) string {
+	return node + "/" + serviceID
+}
+
+func (s *ConsulSyncer) init() {
 	if s.nodes == nil {
 		s.nodes = make(map[string]*consulSyncState)
 	}
 	if s.deregs == nil {
 		s.deregs = make(map[string]*api.CatalogDeregistration)
 	}
-	if s.watchers == nil {
-		s.watchers = make(map[string]context.CancelFunc)
+	if s.written == nil {
+		s.written = make(map[string]*api.CatalogRegistration)
+	}
+	if s.triggerCh == nil {
+		s.triggerCh = make(chan struct{}, 1)
 	}
 	if s.SyncPeriod == 0 {
 		s.SyncPeriod = ConsulSyncPeriod
 	}
 	if s.ServicePollPeriod == 0 {
-		s.ServicePollPeriod = ConsulServicePollPeriod
+		s.ServicePollPeriod = s.SyncPeriod / 4
 	}
 }
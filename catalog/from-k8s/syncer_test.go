@@ -2,6 +2,7 @@ package catalog
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -49,6 +50,326 @@ func TestConsulSyncer_register(t *testing.T) {
 	require.Equal("127.0.0.1", service.Address)
 }
 
+// Test that changes are written without waiting for a full sync and that
+// removed instances are deregistered.
+func TestConsulSyncer_syncChanges(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Disable full syncs
+	s, closer := testConsulSyncerConfig(t, client, func(s *ConsulSyncer) {
+		s.SyncPeriod = time.Hour
+	})
+	defer closer()
+
+	// Sync
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration("foo", "bar"),
+		testRegistration("foo", "baz"),
+	})
+
+	// Both services should be registered
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Services(nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if _, ok := services["bar"]; !ok {
+			r.Fatal("bar not found")
+		}
+		if _, ok := services["baz"]; !ok {
+			r.Fatal("baz not found")
+		}
+	})
+
+	// Remove a service
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration("foo", "bar"),
+	})
+
+	// Removed service should be deregistered
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("baz", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) > 0 {
+			r.Fatal("service still exists")
+		}
+	})
+
+	services, _, err := client.Catalog().Service("bar", "", nil)
+	require.NoError(err)
+	require.Len(services, 1)
+}
+
+// Test that registrations and deregistrations, including those of checks,
+// are written in transactions that are split to fit in the Consul limits.
+func TestConsulSyncer_txn(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncerConfig(t, client, func(s *ConsulSyncer) {
+		s.UseTxn = true
+	})
+	defer closer()
+
+	// Sync more instances than fit in a single transaction
+	var regs []*api.CatalogRegistration
+	for i := 0; i < 50; i++ {
+		reg := testRegistration("foo", "bar")
+		reg.Service.ID = serviceID("foo", fmt.Sprintf("bar-%d", i))
+		reg.Checks = api.HealthChecks{readinessCheck(reg, true)}
+		regs = append(regs, reg)
+	}
+	s.Sync(regs)
+
+	// All instances should be registered with their checks
+	retry.Run(t, func(r *retry.R) {
+		entries, _, err := client.Health().Service("bar", "", true, nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(entries) != len(regs) {
+			r.Fatalf("expected %d healthy instances, got %d", len(regs), len(entries))
+		}
+	})
+
+	// Remove most of the instances
+	s.Sync(regs[:10])
+
+	// Removed instances should be deregistered
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("bar", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) != 10 {
+			r.Fatalf("expected 10 instances, got %d", len(services))
+		}
+	})
+
+	// Remove the checks of the remaining instances
+	var unchecked []*api.CatalogRegistration
+	for _, reg := range regs[:10] {
+		copied := *reg
+		copied.Checks = nil
+		unchecked = append(unchecked, &copied)
+	}
+	s.Sync(unchecked)
+
+	// Removed checks should be deregistered
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err := client.Health().Checks("bar", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(checks) > 0 {
+			r.Fatalf("expected no checks, got %d", len(checks))
+		}
+	})
+
+	// Verify the settings
+	services, _, err := client.Catalog().Service("bar", "", nil)
+	require.NoError(err)
+	require.Equal("foo", services[0].Node)
+	require.Equal("127.0.0.1", services[0].Address)
+	require.Equal(TestConsulK8STag, services[0].ServiceTags[0])
+}
+
+// Test that nothing is written in a dry run.
+func TestConsulSyncer_dryRun(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncerConfig(t, client, func(s *ConsulSyncer) {
+		s.DryRun = true
+	})
+	defer closer()
+
+	// Sync
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration("foo", "bar"),
+	})
+
+	// Wait for the changes and a full sync to run
+	time.Sleep(2 * ConsulSyncQuietPeriod)
+
+	// Verify the service wasn't registered
+	services, _, err := client.Catalog().Service("bar", "", nil)
+	require.NoError(err)
+	require.Len(services, 0)
+}
+
+// Test that checks are registered along with the service instance.
+func TestConsulSyncer_registerChecks(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncer(t, client)
+	defer closer()
+
+	// Sync
+	reg := testRegistration("foo", "bar")
+	reg.Checks = api.HealthChecks{readinessCheck(reg, false)}
+	s.Sync([]*api.CatalogRegistration{reg})
+
+	// Read the check back out
+	var checks api.HealthChecks
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		checks, _, err = client.Health().Checks("bar", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(checks) == 0 {
+			r.Fatal("check not found")
+		}
+	})
+
+	// Verify the settings
+	require.Len(checks, 1)
+	require.Equal(readinessCheckID(serviceID("foo", "bar")), checks[0].CheckID)
+	require.Equal(api.HealthCritical, checks[0].Status)
+}
+
+// Test that syncing doesn't reset the status of checks with a definition,
+// which are run outside of the sync.
+func TestConsulSyncer_customCheckStatus(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncer(t, client)
+	defer closer()
+
+	testReg := func() *api.CatalogRegistration {
+		reg := testRegistration("foo", "bar")
+		reg.Checks = api.HealthChecks{&api.HealthCheck{
+			CheckID:     customCheckID(reg.Service.ID, "http"),
+			Name:        "http",
+			ServiceID:   reg.Service.ID,
+			ServiceName: reg.Service.Service,
+			Status:      api.HealthPassing,
+			Definition: api.HealthCheckDefinition{
+				HTTP:             "http://127.0.0.1:8080/health",
+				IntervalDuration: 10 * time.Second,
+			},
+		}}
+		return reg
+	}
+
+	// Sync
+	s.Sync([]*api.CatalogRegistration{testReg()})
+
+	var checks api.HealthChecks
+	retry.Run(t, func(r *retry.R) {
+		var err error
+		checks, _, err = client.Health().Checks("bar", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(checks) == 0 {
+			r.Fatal("check not found")
+		}
+	})
+	require.Equal(api.HealthPassing, checks[0].Status)
+	require.Equal("http://127.0.0.1:8080/health", checks[0].Definition.HTTP)
+
+	// Update the status outside of the sync
+	reg := testReg()
+	reg.Checks[0].Status = api.HealthCritical
+	_, err := client.Catalog().Register(reg, nil)
+	require.NoError(err)
+
+	// Sync again and wait for full syncs
+	s.Sync([]*api.CatalogRegistration{testReg()})
+	time.Sleep(500 * time.Millisecond)
+
+	checks, _, err = client.Health().Checks("bar", nil)
+	require.NoError(err)
+	require.Len(checks, 1)
+	require.Equal(api.HealthCritical, checks[0].Status)
+}
+
+// Test that checks removed from a registration are deregistered when the
+// registration is written.
+func TestConsulSyncer_removedChecks(t *testing.T) {
+	t.Parallel()
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncer(t, client)
+	defer closer()
+
+	reg := testRegistration("foo", "bar")
+	check := func(checkType string) *api.HealthCheck {
+		return &api.HealthCheck{
+			CheckID:     customCheckID(reg.Service.ID, checkType),
+			Name:        checkType,
+			ServiceID:   reg.Service.ID,
+			ServiceName: reg.Service.Service,
+			Definition: api.HealthCheckDefinition{
+				TCP:              "127.0.0.1:8080",
+				IntervalDuration: 10 * time.Second,
+			},
+		}
+	}
+	waitChecks := func(expected ...string) {
+		retry.Run(t, func(r *retry.R) {
+			checks, _, err := client.Health().Checks("bar", nil)
+			if err != nil {
+				r.Fatalf("err: %s", err)
+			}
+
+			var actual []string
+			for _, c := range checks {
+				actual = append(actual, c.CheckID)
+			}
+			if fmt.Sprint(actual) != fmt.Sprint(expected) {
+				r.Fatalf("bad checks: %v", actual)
+			}
+		})
+	}
+
+	// Sync with a check
+	withCheck := *reg
+	withCheck.Checks = api.HealthChecks{check("tcp")}
+	s.Sync([]*api.CatalogRegistration{&withCheck})
+	waitChecks(customCheckID(reg.Service.ID, "tcp"))
+
+	// Sync without the check
+	s.Sync([]*api.CatalogRegistration{reg})
+	waitChecks()
+}
+
 // Test that the syncer reaps invalid services
 func TestConsulSyncer_reapService(t *testing.T) {
 	t.Parallel()
@@ -189,6 +510,66 @@ func TestConsulSyncer_reapServiceOtherNamespace(t *testing.T) {
 	require.Len(services, 1)
 }
 
+// Test that the syncer does not reap services from another cluster.
+func TestConsulSyncer_reapServiceOtherCluster(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncerConfig(t, client, func(s *ConsulSyncer) {
+		s.ClusterName = "east"
+	})
+	defer closer()
+
+	// Sync
+	reg := testRegistration("foo", "bar")
+	reg.NodeMeta[ConsulK8SCluster] = "east"
+	reg.Service.Meta[ConsulK8SCluster] = "east"
+	s.Sync([]*api.CatalogRegistration{reg})
+
+	// Wait for the service so the node is registered with our cluster
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("bar", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) != 1 {
+			r.Fatal("service not found or too many")
+		}
+	})
+
+	// Create a service from another cluster and one from ours that is
+	// invalid directly in Consul
+	other := testRegistration("foo", "baz")
+	other.Service.Meta[ConsulK8SCluster] = "west"
+	_, err := client.Catalog().Register(other, nil)
+	require.NoError(err)
+	invalid := testRegistration("foo", "qux")
+	invalid.Service.Meta[ConsulK8SCluster] = "east"
+	_, err = client.Catalog().Register(invalid, nil)
+	require.NoError(err)
+
+	// Invalid service from our cluster should be reaped
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("qux", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) > 0 {
+			r.Fatal("service still exists")
+		}
+	})
+
+	// Service from the other cluster should exist
+	services, _, err := client.Catalog().Service("baz", "", nil)
+	require.NoError(err)
+	require.Len(services, 1)
+}
+
 // Test that the syncer reaps services with no NS set.
 func TestConsulSyncer_reapServiceSameNamespace(t *testing.T) {
 	t.Parallel()
@@ -243,11 +624,110 @@ func TestConsulSyncer_reapServiceSameNamespace(t *testing.T) {
 	require.Equal("127.0.0.1", service.Address)
 }
 
+// Test that the syncer registers instances deleted outside of the syncer
+// again without waiting for a full sync.
+func TestConsulSyncer_reregisterDeleted(t *testing.T) {
+	t.Parallel()
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	// Disable full syncs
+	s, closer := testConsulSyncerConfig(t, client, func(s *ConsulSyncer) {
+		s.SyncPeriod = time.Hour
+	})
+	defer closer()
+
+	// Sync
+	reg := testRegistration("foo", "bar")
+	s.Sync([]*api.CatalogRegistration{reg})
+
+	// Wait for the service
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("bar", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) != 1 {
+			r.Fatal("service not found or too many")
+		}
+	})
+
+	// Delete the service directly in Consul
+	_, err := client.Catalog().Deregister(&api.CatalogDeregistration{
+		Node:      reg.Node,
+		ServiceID: reg.Service.ID,
+	}, nil)
+	require.NoError(t, err)
+
+	// Service should be registered again
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Service("bar", "", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if len(services) != 1 {
+			r.Fatal("service not found or too many")
+		}
+	})
+}
+
+// Test that the syncer reaps K8S nodes that have no services.
+func TestConsulSyncer_reapNode(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := agent.NewTestAgent(t, t.Name(), ``)
+	defer a.Shutdown()
+	testrpc.WaitForTestAgent(t, a.RPC, "dc1")
+	client := a.Client()
+
+	s, closer := testConsulSyncer(t, client)
+	defer closer()
+
+	// Sync
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration("foo", "bar"),
+	})
+
+	// Create an empty K8S node and a K8S node with a service that
+	// isn't ours directly in Consul
+	_, err := client.Catalog().Register(&api.CatalogRegistration{
+		Node:     "empty",
+		Address:  "127.0.0.1",
+		NodeMeta: map[string]string{ConsulSourceKey: ConsulSourceValue},
+	}, nil)
+	require.NoError(err)
+	other := testRegistration("other", "baz")
+	other.Service.Meta[ConsulK8SNS] = "other"
+	_, err = client.Catalog().Register(other, nil)
+	require.NoError(err)
+
+	// Reaped node should not exist
+	retry.Run(t, func(r *retry.R) {
+		node, _, err := client.Catalog().Node("empty", nil)
+		if err != nil {
+			r.Fatalf("err: %s", err)
+		}
+		if node != nil {
+			r.Fatal("node still exists")
+		}
+	})
+
+	// Node with services should exist
+	node, _, err := client.Catalog().Node("other", nil)
+	require.NoError(err)
+	require.NotNil(node)
+	require.Len(node.Services, 1)
+}
+
 func testRegistration(node, service string) *api.CatalogRegistration {
 	return &api.CatalogRegistration{
 		Node:           node,
 		Address:        "127.0.0.1",
-		NodeMeta:       map[string]string{ConsulSourceKey: TestConsulK8STag},
+		NodeMeta:       map[string]string{ConsulSourceKey: ConsulSourceValue},
 		SkipNodeUpdate: true,
 		Service: &api.AgentService{
 			ID:      serviceID(node, service),
@@ -262,6 +742,12 @@ func testRegistration(node, service string) *api.CatalogRegistration {
 }
 
 func testConsulSyncer(t *testing.T, client *api.Client) (*ConsulSyncer, func()) {
+	return testConsulSyncerConfig(t, client, func(*ConsulSyncer) {})
+}
+
+// testConsulSyncerConfig creates a ConsulSyncer for testing, calling the
+// given function to configure it before it is started.
+func testConsulSyncerConfig(t *testing.T, client *api.Client, f func(*ConsulSyncer)) (*ConsulSyncer, func()) {
 	s := &ConsulSyncer{
 		Client:            client,
 		Log:               hclog.Default(),
@@ -270,6 +756,7 @@ func testConsulSyncer(t *testing.T, client *api.Client) (*ConsulSyncer, func())
 		Namespace:         "default",
 		ConsulK8STag:      TestConsulK8STag,
 	}
+	f(s)
 
 	ctx, cancelF := context.WithCancel(context.Background())
 	doneCh := make(chan struct{})
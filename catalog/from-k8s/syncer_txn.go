@@ -0,0 +1,333 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cenkalti/backoff"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// consulTxnMaxOps is the maximum number of operations Consul allows in
+	// a single transaction.
+	consulTxnMaxOps = 64
+
+	// consulTxnMaxSize is the maximum size of the operations in a single
+	// transaction. Consul limits the request to 512KB by default so this
+	// leaves plenty of room for the encoding overhead.
+	consulTxnMaxSize = 256 * 1024
+
+	// consulTxnMaxRetries is the number of times a transaction is retried
+	// before its operations are considered failed.
+	consulTxnMaxRetries = 3
+)
+
+// txnItem is the set of transaction operations for a single registration
+// or deregistration. The operations of an item are always in the same
+// transaction.
+type txnItem struct {
+	// Key is the key of the registration or deregistration.
+	Key string
+
+	// NodeOp is the operation to register the node, if required. This is
+	// kept separate from Ops so it is only included once per transaction.
+	NodeOp *api.TxnOp
+
+	// Ops are the other operations.
+	Ops api.TxnOps
+
+	// Size is the approximate encoded size of the operations.
+	Size int
+}
+
+// registerTxn writes the given registrations to Consul in transactions.
+func (s *ConsulSyncer) registerTxn(ctx context.Context, regs map[string]*api.CatalogRegistration) map[string]error {
+	errs := make(map[string]error)
+	if len(regs) == 0 {
+		return errs
+	}
+
+	// Nodes that already exist are only updated if the registration
+	// doesn't skip node updates, just like a catalog registration. Only
+	// the nodes registered from K8S are listed since node updates are only
+	// skipped for those.
+	nodes, _, err := s.Client.Catalog().Nodes(&api.QueryOptions{
+		AllowStale: true,
+		NodeMeta:   s.nodeMeta(),
+	})
+	if err != nil {
+		for k := range regs {
+			errs[k] = err
+		}
+		return errs
+	}
+	existing := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		existing[n.Node] = struct{}{}
+	}
+
+	items := make([]*txnItem, 0, len(regs))
+	for k, r := range regs {
+		item := &txnItem{Key: k}
+		if _, ok := existing[r.Node]; !ok || !r.SkipNodeUpdate {
+			item.NodeOp = &api.TxnOp{
+				Node: &api.NodeTxnOp{
+					Verb: api.NodeSet,
+					Node: api.Node{
+						ID:              r.ID,
+						Node:            r.Node,
+						Address:         r.Address,
+						Datacenter:      r.Datacenter,
+						TaggedAddresses: r.TaggedAddresses,
+						Meta:            r.NodeMeta,
+					},
+				},
+			}
+		}
+
+		if r.Service != nil {
+			svc := *r.Service
+
+			// Unlike catalog registrations, transactions don't default
+			// the weights of the service.
+			if svc.Weights.Passing == 0 && svc.Weights.Warning == 0 {
+				svc.Weights = api.AgentWeights{Passing: 1, Warning: 1}
+			}
+
+			item.Ops = append(item.Ops, &api.TxnOp{
+				Service: &api.ServiceTxnOp{
+					Verb:    api.ServiceSet,
+					Node:    r.Node,
+					Service: svc,
+				},
+			})
+		}
+
+		checks := r.Checks
+		if c := r.Check; c != nil {
+			checks = append(api.HealthChecks{&api.HealthCheck{
+				CheckID:     c.CheckID,
+				Name:        c.Name,
+				Status:      c.Status,
+				Notes:       c.Notes,
+				Output:      c.Output,
+				ServiceID:   c.ServiceID,
+				ServiceName: c.ServiceName,
+				Definition:  c.Definition,
+			}}, checks...)
+		}
+		for _, c := range checks {
+			check := *c
+			check.Node = r.Node
+			item.Ops = append(item.Ops, &api.TxnOp{
+				Check: &api.CheckTxnOp{
+					Verb:  api.CheckSet,
+					Check: check,
+				},
+			})
+		}
+
+		items = append(items, item)
+	}
+
+	s.writeTxn(ctx, items, errs)
+	return errs
+}
+
+// deregisterTxn removes the given deregistrations from Consul in
+// transactions.
+func (s *ConsulSyncer) deregisterTxn(ctx context.Context, deregs map[string]*api.CatalogDeregistration) map[string]error {
+	errs := make(map[string]error)
+	items := make([]*txnItem, 0, len(deregs))
+	for k, r := range deregs {
+		item := &txnItem{Key: k}
+		switch {
+		case r.ServiceID != "":
+			// Consul requires a service name for every service operation,
+			// even though deletes only use the ID, so the ID is used.
+			item.Ops = api.TxnOps{&api.TxnOp{
+				Service: &api.ServiceTxnOp{
+					Verb:    api.ServiceDelete,
+					Node:    r.Node,
+					Service: api.AgentService{ID: r.ServiceID, Service: r.ServiceID},
+				},
+			}}
+
+		case r.CheckID != "":
+			item.Ops = api.TxnOps{&api.TxnOp{
+				Check: &api.CheckTxnOp{
+					Verb:  api.CheckDelete,
+					Check: api.HealthCheck{Node: r.Node, CheckID: r.CheckID},
+				},
+			}}
+
+		default:
+			item.Ops = api.TxnOps{&api.TxnOp{
+				Node: &api.NodeTxnOp{
+					Verb: api.NodeDelete,
+					Node: api.Node{Node: r.Node},
+				},
+			}}
+		}
+
+		items = append(items, item)
+	}
+
+	s.writeTxn(ctx, items, errs)
+	return errs
+}
+
+// writeTxn splits the given items into transactions that are within the
+// Consul limits and writes them. The errors of the items that failed are
+// added to errs.
+func (s *ConsulSyncer) writeTxn(ctx context.Context, items []*txnItem, errs map[string]error) {
+	var chunk []*txnItem
+	var chunkNodes map[string]struct{}
+	var chunkOps, chunkSize int
+	for _, item := range items {
+		if err := item.computeSize(); err != nil {
+			errs[item.Key] = err
+			continue
+		}
+
+		// Start a new transaction if this item doesn't fit. An item that
+		// doesn't fit in an empty transaction is attempted on its own and
+		// Consul will report the error.
+		ops, size := item.Len(chunkNodes), item.Size
+		if len(chunk) > 0 && (chunkOps+ops > consulTxnMaxOps || chunkSize+size > consulTxnMaxSize) {
+			s.writeTxnChunk(ctx, chunk, errs)
+			chunk, chunkNodes, chunkOps, chunkSize = nil, nil, 0, 0
+			ops = item.Len(chunkNodes)
+		}
+
+		chunk = append(chunk, item)
+		chunkOps += ops
+		chunkSize += size
+		if item.NodeOp != nil {
+			if chunkNodes == nil {
+				chunkNodes = make(map[string]struct{})
+			}
+			chunkNodes[item.NodeOp.Node.Node.Node] = struct{}{}
+		}
+	}
+
+	if len(chunk) > 0 {
+		s.writeTxnChunk(ctx, chunk, errs)
+	}
+}
+
+// writeTxnChunk writes the given items in a single transaction, retrying
+// on errors until the given context is cancelled. If operations fail, then
+// the transaction is rolled back and it is retried without the items of
+// the failed operations.
+func (s *ConsulSyncer) writeTxnChunk(ctx context.Context, chunk []*txnItem, errs map[string]error) {
+	err := backoff.Retry(func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		ops, owners := txnOps(chunk)
+		ok, resp, _, err := s.Client.Txn().Txn(ops, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		// The transaction was rolled back. Drop the items with failed
+		// operations so the rest can be retried.
+		failed := make(map[int]struct{})
+		for _, e := range resp.Errors {
+			if e.OpIndex < 0 || e.OpIndex >= len(owners) {
+				continue
+			}
+
+			i := owners[e.OpIndex]
+			errs[chunk[i].Key] = errors.New(e.What)
+			failed[i] = struct{}{}
+		}
+		if len(failed) == 0 {
+			return fmt.Errorf("transaction rolled back")
+		}
+
+		remaining := make([]*txnItem, 0, len(chunk)-len(failed))
+		for i, item := range chunk {
+			if _, ok := failed[i]; !ok {
+				remaining = append(remaining, item)
+			}
+		}
+		chunk = remaining
+
+		return fmt.Errorf("transaction rolled back")
+	}, backoff.WithContext(
+		backoff.WithMaxRetries(backoff.NewExponentialBackOff(), consulTxnMaxRetries), ctx))
+	if err != nil {
+		for _, item := range chunk {
+			if _, ok := errs[item.Key]; !ok {
+				errs[item.Key] = err
+			}
+		}
+	}
+}
+
+// txnOps returns the operations of the given items along with the index
+// of the item that owns each operation. Node operations are only included
+// once per node.
+func txnOps(items []*txnItem) (api.TxnOps, []int) {
+	var ops api.TxnOps
+	var owners []int
+	nodes := make(map[string]struct{})
+	for i, item := range items {
+		if item.NodeOp != nil {
+			if _, ok := nodes[item.NodeOp.Node.Node.Node]; !ok {
+				nodes[item.NodeOp.Node.Node.Node] = struct{}{}
+				ops = append(ops, item.NodeOp)
+				owners = append(owners, i)
+			}
+		}
+
+		for _, op := range item.Ops {
+			ops = append(ops, op)
+			owners = append(owners, i)
+		}
+	}
+
+	return ops, owners
+}
+
+// Len returns the number of operations the item adds to a transaction
+// that already registers the given nodes.
+func (i *txnItem) Len(nodes map[string]struct{}) int {
+	n := len(i.Ops)
+	if i.NodeOp != nil {
+		if _, ok := nodes[i.NodeOp.Node.Node.Node]; !ok {
+			n++
+		}
+	}
+
+	return n
+}
+
+// computeSize sets the approximate encoded size of the item.
+func (i *txnItem) computeSize() error {
+	size := 0
+	if i.NodeOp != nil {
+		b, err := json.Marshal(i.NodeOp)
+		if err != nil {
+			return err
+		}
+		size += len(b)
+	}
+
+	b, err := json.Marshal(i.Ops)
+	if err != nil {
+		return err
+	}
+
+	i.Size = size + len(b)
+	return nil
+}
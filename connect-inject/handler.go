@@ -16,6 +16,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -96,6 +97,11 @@ type Handler struct {
 	// registrations. It will be overridden by a specific annotation.
 	DefaultProtocol string
 
+	// EventRecorder, if set, records events on the pods that are injected
+	// or fail injection. If the pod has no name yet, which is the case for
+	// pods created by a controller, the event is recorded on its controller.
+	EventRecorder record.EventRecorder
+
 	// Log
 	Log hclog.Logger
 }
@@ -178,6 +184,8 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	// Setup the default annotation values that are used for the container.
 	// This MUST be done before shouldInject is called since k.
 	if err := h.defaultAnnotations(&pod, &patches); err != nil {
+		h.recordEvent(&pod, req.Namespace, corev1.EventTypeWarning, "InjectionFailed",
+			"injection failed: %s", err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -187,13 +195,22 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 
 	// Check if we should inject, for example we don't inject in the
 	// system namespaces.
-	if shouldInject, err := h.shouldInject(&pod, req.Namespace); err != nil {
+	if shouldInject, reason, err := h.shouldInject(&pod, req.Namespace); err != nil {
+		h.recordEvent(&pod, req.Namespace, corev1.EventTypeWarning, "InjectionFailed",
+			"injection failed checking if should inject: %s", err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: fmt.Sprintf("Error checking if should inject: %s", err),
 			},
 		}
 	} else if !shouldInject {
+		// Every pod is admitted by the webhook, so skipped pods are only
+		// reported if they explicitly request injection.
+		if requested, _ := strconv.ParseBool(pod.Annotations[annotationInject]); requested {
+			h.recordEvent(&pod, req.Namespace, corev1.EventTypeNormal, "InjectionSkipped",
+				"injection skipped: %s", reason)
+		}
+
 		return resp
 	}
 
@@ -223,6 +240,8 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	// the Envoy configuration.
 	container, err := h.containerInit(&pod)
 	if err != nil {
+		h.recordEvent(&pod, req.Namespace, corev1.EventTypeWarning, "InjectionFailed",
+			"injection failed configuring init container: %s", err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: fmt.Sprintf("Error configuring injection init container: %s", err),
@@ -237,6 +256,8 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	// Add the Envoy sidecar
 	esContainer, err := h.containerSidecar(&pod)
 	if err != nil {
+		h.recordEvent(&pod, req.Namespace, corev1.EventTypeWarning, "InjectionFailed",
+			"injection failed configuring sidecar container: %s", err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: fmt.Sprintf("Error configuring injection sidecar container: %s", err),
@@ -275,35 +296,38 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	return resp
 }
 
-func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error) {
+// shouldInject returns true if the pod should be injected. Otherwise the
+// returned string is the reason it is skipped.
+func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, string, error) {
 
 	// Don't inject in the Kubernetes system namespaces
 	for _, ns := range kubeSystemNamespaces {
 		if namespace == ns {
-			return false, nil
+			return false, fmt.Sprintf("namespace %q is a Kubernetes system namespace", namespace), nil
 		}
 	}
 
 	// If we already injected then don't inject again
 	if pod.Annotations[annotationStatus] != "" {
-		return false, nil
+		return false, "pod is already injected", nil
 	}
 
 	// A service name is required. Whether a proxy accepting connections
 	// or just establishing outbound, a service name is required to acquire
 	// the correct certificate.
 	if pod.Annotations[annotationService] == "" {
-		return false, nil
+		return false, "pod has no service name", nil
 	}
 
 	// If the explicit true/false is on, then take that value. Note that
 	// this has to be the last check since it sets a default value after
 	// all other checks.
 	if raw, ok := pod.Annotations[annotationInject]; ok {
-		return strconv.ParseBool(raw)
+		inject, err := strconv.ParseBool(raw)
+		return inject, "injection is disabled by annotation", err
 	}
 
-	return !h.RequireAnnotation, nil
+	return !h.RequireAnnotation, "injection requires an annotation", nil
 }
 
 func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonPatchOperation) error {
@@ -369,6 +393,35 @@ func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonP
 	return nil
 }
 
+// recordEvent records an event on the given pod, or on its controller if
+// the pod doesn't have a name yet.
+func (h *Handler) recordEvent(pod *corev1.Pod, namespace, eventType, reason, messageFmt string, args ...interface{}) {
+	if h.EventRecorder == nil {
+		return
+	}
+
+	ref := &corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+	if ref.Name == "" {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil {
+			return
+		}
+
+		ref.Kind = owner.Kind
+		ref.APIVersion = owner.APIVersion
+		ref.Name = owner.Name
+		ref.UID = owner.UID
+	}
+
+	h.EventRecorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
 func portValue(pod *corev1.Pod, value string) (int32, error) {
 	// First search for the named port
 	for _, c := range pod.Spec.Containers {
@@ -13,6 +13,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestHandlerHandle(t *testing.T) {
@@ -307,6 +308,79 @@ func TestHandlerHandle(t *testing.T) {
 	}
 }
 
+// Test that events are recorded on the pod or its controller when injection
+// fails or is skipped.
+func TestHandlerMutate_events(t *testing.T) {
+	require := require.New(t)
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{
+		Log:           hclog.Default().Named("handler"),
+		EventRecorder: recorder,
+	}
+
+	// Successful injection isn't recorded
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web"}},
+		},
+	}
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.Len(recorder.Events, 0)
+
+	// Skipped injection is only recorded if it was requested
+	resp = h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: metav1.NamespaceSystem,
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.Len(recorder.Events, 0)
+
+	pod.Annotations = map[string]string{annotationInject: "true"}
+	resp = h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: metav1.NamespaceSystem,
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+	require.Equal(`Normal InjectionSkipped injection skipped: namespace "kube-system" is a Kubernetes system namespace`,
+		<-recorder.Events)
+
+	// Failed injection of a pod without a name is recorded on its
+	// controller, and pods without a controller are skipped.
+	h.AuthMethod = "k8s"
+	controllerPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "web-",
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(&corev1.ReplicationController{
+					ObjectMeta: metav1.ObjectMeta{Name: "web"},
+				}, corev1.SchemeGroupVersion.WithKind("ReplicationController")),
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web"}},
+		},
+	}
+	resp = h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, controllerPod),
+	})
+	require.False(resp.Allowed)
+	require.Contains(<-recorder.Events, "Warning InjectionFailed")
+
+	controllerPod.OwnerReferences = nil
+	resp = h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, controllerPod),
+	})
+	require.False(resp.Allowed)
+	require.Len(recorder.Events, 0)
+}
+
 // Test that an incorrect content type results in an error.
 func TestHandlerHandle_badContentType(t *testing.T) {
 	req, err := http.NewRequest("POST", "/", nil)
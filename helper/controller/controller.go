@@ -22,6 +22,9 @@ type Controller struct {
 	Log      hclog.Logger
 	Resource Resource
 
+	// Name is the name of the controller used to label its metrics.
+	Name string
+
 	informer cache.SharedIndexInformer
 }
 
@@ -53,6 +56,7 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 			c.Log.Debug("queue", "op", "add", "key", key)
 			if err == nil {
 				queue.Add(key)
+				c.setQueueDepth(queue)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
@@ -60,12 +64,14 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 			c.Log.Debug("queue", "op", "update", "key", key)
 			if err == nil {
 				queue.Add(key)
+				c.setQueueDepth(queue)
 			}
 		}, DeleteFunc: func(obj interface{}) {
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 			c.Log.Debug("queue", "op", "delete", "key", key)
 			if err == nil {
 				queue.Add(key)
+				c.setQueueDepth(queue)
 			}
 		},
 	})
@@ -153,6 +159,7 @@ func (c *Controller) processSingle(
 		return false
 	}
 	defer queue.Done(key)
+	c.setQueueDepth(queue)
 
 	// The key should be a string. If it isn't, just ignore it.
 	keyRaw, ok := key.(string)
@@ -183,12 +190,19 @@ func (c *Controller) processSingle(
 		if queue.NumRequeues(key) < 5 {
 			c.Log.Error("failed processing item, retrying", "key", keyRaw, "error", err)
 			queue.AddRateLimited(key)
+			metricRetries.WithLabelValues(c.Name).Inc()
 		} else {
 			c.Log.Error("failed processing item, no more retries", "key", keyRaw, "error", err)
 			queue.Forget(key)
+			metricDropped.WithLabelValues(c.Name).Inc()
 			utilruntime.HandleError(err)
 		}
 	}
 
 	return true
 }
+
+// setQueueDepth updates the queue depth metric of the controller.
+func (c *Controller) setQueueDepth(queue workqueue.Interface) {
+	metricQueueDepth.WithLabelValues(c.Name).Set(float64(queue.Len()))
+}
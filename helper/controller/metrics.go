@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// metricQueueDepth is the number of keys waiting to be processed.
+	metricQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "consul_k8s",
+		Subsystem: "controller",
+		Name:      "queue_depth",
+		Help:      "Number of keys waiting in the work queue of the controller.",
+	}, []string{"controller"})
+
+	// metricRetries is the number of keys requeued after failing.
+	metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consul_k8s",
+		Subsystem: "controller",
+		Name:      "retries_total",
+		Help:      "Number of keys requeued after failing to be processed.",
+	}, []string{"controller"})
+
+	// metricDropped is the number of keys dropped after too many retries.
+	metricDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consul_k8s",
+		Subsystem: "controller",
+		Name:      "dropped_total",
+		Help:      "Number of keys dropped after failing to be processed too many times.",
+	}, []string{"controller"})
+)
+
+func init() {
+	prometheus.MustRegister(metricQueueDepth, metricRetries, metricDropped)
+}
@@ -0,0 +1,23 @@
+package subcommand
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventRecorder returns a record.EventRecorder that posts events to
+// Kubernetes with the given component as their source. Events are created
+// in the namespace of the object they are about.
+func EventRecorder(client kubernetes.Interface, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+
+	return broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{
+		Component: component,
+	})
+}
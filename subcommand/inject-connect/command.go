@@ -14,6 +14,7 @@ import (
 
 	"github.com/hashicorp/consul-k8s/connect-inject"
 	"github.com/hashicorp/consul-k8s/helper/cert"
+	"github.com/hashicorp/consul-k8s/subcommand"
 	"github.com/hashicorp/consul/command/flags"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
@@ -115,6 +116,7 @@ func (c *Command) Run(args []string) int {
 		AuthMethod:        c.flagACLAuthMethod,
 		CentralConfig:     c.flagCentralConfig,
 		DefaultProtocol:   c.flagDefaultProtocol,
+		EventRecorder:     subcommand.EventRecorder(clientset, "consul-k8s-connect-injector"),
 		Log:               hclog.Default().Named("handler"),
 	}
 	mux := http.NewServeMux()
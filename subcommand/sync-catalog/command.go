@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
 	"time"
 
@@ -19,9 +20,13 @@ import (
 	"github.com/hashicorp/consul/command/flags"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/record"
 )
 
 // Command is the command for syncing the K8S and Consul service
@@ -37,14 +42,40 @@ type Command struct {
 	flagToK8S                 bool
 	flagConsulDomain          string
 	flagConsulK8STag          string
+	flagConsulRequireTags     flags.AppendSliceValue
+	flagConsulExcludeTags     flags.AppendSliceValue
+	flagConsulNodeMeta        flags.FlagMapValue
+	flagConsulFilter          string
+	flagConsulDatacenters     flags.AppendSliceValue
 	flagK8SDefault            bool
 	flagK8SServicePrefix      string
 	flagConsulServicePrefix   string
 	flagK8SSourceNamespace    string
 	flagK8SWriteNamespace     string
+	flagK8SNamespaceMetaKey   string
+	flagK8SNamespaceTagPrefix string
+	flagK8SNamespacePrefixes  flags.FlagMapValue
+	flagK8SSyncEndpoints      bool
+	flagK8SAdoptServices      bool
+	flagK8SOwner              string
+	flagK8SServiceDetails     bool
+	flagK8SLabelMetaKeys      flags.AppendSliceValue
+	flagAllowK8SNamespaces    flags.AppendSliceValue
+	flagDenyK8SNamespaces     flags.AppendSliceValue
+	flagK8SServiceSelector    string
+	flagK8SClusterName        string
 	flagConsulWritePeriod     flags.DurationValue
+	flagConsulWriteTxn        bool
 	flagSyncClusterIPServices bool
 	flagNodePortSyncType      string
+	flagSyncK8SNodes          bool
+	flagSyncIngresses         bool
+	flagServiceIDStrategy     string
+	flagSyncPodLabels         flags.AppendSliceValue
+	flagLeaderElection        bool
+	flagLeaderElectionNS      string
+	flagLeaderElectionName    string
+	flagDryRun                bool
 	flagLogLevel              string
 
 	consulClient *api.Client
@@ -73,24 +104,136 @@ func (c *Command) init() {
 	c.flags.StringVar(&c.flagK8SSourceNamespace, "k8s-source-namespace", metav1.NamespaceAll,
 		"The Kubernetes namespace to watch for service changes and sync to Consul. "+
 			"If this is not set then it will default to all namespaces.")
+	c.flags.Var(&c.flagAllowK8SNamespaces, "allow-k8s-namespace",
+		"A Kubernetes namespace to sync services from, which may contain glob "+
+			"patterns such as \"team-*\". May be specified multiple times. If this "+
+			"is not set then all namespaces are allowed.")
+	c.flags.Var(&c.flagDenyK8SNamespaces, "deny-k8s-namespace",
+		"A Kubernetes namespace to never sync services from, which may contain "+
+			"glob patterns such as \"team-*\". May be specified multiple times. "+
+			"This takes precedence over -allow-k8s-namespace.")
+	c.flags.StringVar(&c.flagK8SServiceSelector, "k8s-service-selector", "",
+		"A Kubernetes label selector that services must match to be synced to "+
+			"Consul, such as \"app=web,tier!=cache\". If this is not set then "+
+			"all services are considered.")
+	c.flags.StringVar(&c.flagK8SClusterName, "k8s-cluster-name", "",
+		"The name of the Kubernetes cluster, which must be unique for every cluster "+
+			"syncing into the same Consul datacenter. Services synced to Consul are "+
+			"registered on a node named \"k8s-sync-<name>\" with the cluster name "+
+			"as meta, and only services from this cluster are removed from Consul. "+
+			"Services synced before this was set stay on the \"k8s-sync\" node and "+
+			"are not removed, so that node should be deregistered from Consul once "+
+			"the services are synced to the new node.")
 	c.flags.StringVar(&c.flagK8SWriteNamespace, "k8s-write-namespace", metav1.NamespaceDefault,
 		"The Kubernetes namespace to write to for services from Consul. "+
 			"If this is not set then it will default to the default namespace.")
+	c.flags.StringVar(&c.flagK8SNamespaceMetaKey, "k8s-namespace-meta-key", "",
+		"A Consul service meta key whose value is the Kubernetes namespace to write "+
+			"the service to, rather than -k8s-write-namespace. This requires "+
+			"-k8s-service-details.")
+	c.flags.StringVar(&c.flagK8SNamespaceTagPrefix, "k8s-namespace-tag-prefix", "",
+		"A Consul service tag prefix. The rest of the first tag of a service with the "+
+			"prefix is the Kubernetes namespace to write the service to.")
+	c.flags.Var(&c.flagK8SNamespacePrefixes, "k8s-namespace-prefix",
+		"A rule in the form of prefix=namespace that writes Consul services whose "+
+			"name starts with the prefix to the Kubernetes namespace. May be specified "+
+			"multiple times, in which case the longest matching prefix is used. Rules "+
+			"are applied after -k8s-namespace-meta-key and -k8s-namespace-tag-prefix.")
 	c.flags.StringVar(&c.flagConsulDomain, "consul-domain", "consul",
 		"The domain for Consul services to use when writing services to "+
 			"Kubernetes. Defaults to consul.")
 	c.flags.StringVar(&c.flagConsulK8STag, "consul-k8s-tag", "k8s",
 		"Tag value for K8S services registered in Consul")
+	c.flags.Var(&c.flagConsulRequireTags, "consul-require-tag",
+		"A tag that Consul services must have to be synced to Kubernetes. May be "+
+			"specified multiple times, in which case services must have all the tags.")
+	c.flags.Var(&c.flagConsulExcludeTags, "consul-exclude-tag",
+		"A tag that excludes Consul services from being synced to Kubernetes. May "+
+			"be specified multiple times.")
+	c.flags.Var(&c.flagConsulNodeMeta, "consul-node-meta",
+		"Node meta in the form of key=value that Consul services must have "+
+			"instances on to be synced to Kubernetes. May be specified multiple times.")
+	c.flags.StringVar(&c.flagConsulFilter, "consul-filter", "",
+		"A Consul filter expression, such as 'ServiceMeta.team == \"web\"'. Consul "+
+			"services are only synced to Kubernetes if an instance matches. This "+
+			"requires a request per service so tag and node meta filters should "+
+			"be preferred.")
+	c.flags.BoolVar(&c.flagK8SSyncEndpoints, "k8s-sync-endpoints", false,
+		"If true, Consul services are synced to Kubernetes as ClusterIP services "+
+			"with endpoints for their healthy instances rather than as ExternalName "+
+			"services. All instances of a service should share the same port.")
+	c.flags.BoolVar(&c.flagK8SServiceDetails, "k8s-service-details", false,
+		"If true, the Kubernetes services created for Consul services have the port "+
+			"used by most instances, and the service tags and the meta shared by all "+
+			"instances as annotations. This requires a request per service.")
+	c.flags.Var(&c.flagK8SLabelMetaKeys, "k8s-label-meta-key",
+		"A Consul service meta key to add as a label to the Kubernetes services created "+
+			"for Consul services. May be specified multiple times. This requires "+
+			"-k8s-service-details.")
+	c.flags.BoolVar(&c.flagK8SAdoptServices, "k8s-adopt-services", false,
+		"If true, existing Kubernetes services with the \"consul=true\" label, such as "+
+			"services created by earlier versions of catalog sync, are managed as if "+
+			"they were created by catalog sync. Otherwise only services with the "+
+			"\"app.kubernetes.io/managed-by=consul-k8s-sync-catalog\" label are "+
+			"updated or deleted.")
+	c.flags.StringVar(&c.flagK8SOwner, "k8s-owner", "",
+		"A name for this catalog sync that is unique among the catalog syncs writing "+
+			"to the same Kubernetes cluster. It is set as a label on the services "+
+			"synced from Consul and only services with the same owner are updated or "+
+			"deleted. This defaults to the namespace catalog sync is running in.")
+	c.flags.Var(&c.flagConsulDatacenters, "consul-datacenter",
+		"A Consul datacenter to sync services to Kubernetes from. May be specified "+
+			"multiple times in order of preference. Services from a remote datacenter "+
+			"point to <name>.service.<datacenter>.<domain>. If this is not set then "+
+			"the local datacenter is used.")
 	c.flags.Var(&c.flagConsulWritePeriod, "consul-write-interval",
-		"The interval to perform syncing operations creating Consul services, formatted "+
-			"as a time.Duration. All changes are merged and write calls are only made "+
-			"on this interval. Defaults to 30 seconds (30s).")
+		"The interval to perform full syncs re-registering all Consul services, formatted "+
+			"as a time.Duration. Changes are written to Consul as they happen, this only "+
+			"corrects drift in Consul. Defaults to 30 seconds (30s).")
+	c.flags.BoolVar(&c.flagConsulWriteTxn, "consul-write-txn", false,
+		"If true, services are written to Consul in batches using the transaction "+
+			"API rather than with a request per service instance. This requires "+
+			"Consul 1.4 or later.")
 	c.flags.BoolVar(&c.flagSyncClusterIPServices, "sync-clusterip-services", true,
 		"If true, all valid ClusterIP services in K8S are synced by default. If false, "+
 			"ClusterIP services are not synced to Consul.")
 	c.flags.StringVar(&c.flagNodePortSyncType, "node-port-sync-type", "ExternalOnly",
 		"Defines the type of sync for NodePort services. Valid options are ExternalOnly, "+
 			"InternalOnly and ExternalFirst.")
+	c.flags.BoolVar(&c.flagSyncK8SNodes, "sync-k8s-nodes", false,
+		"If true, ClusterIP and NodePort service instances are registered in Consul "+
+			"on a node named after the Kubernetes node they run on, rather than on "+
+			"a single shared node. This should not be used if Consul clients run "+
+			"with the same node names as the Kubernetes nodes. This requires "+
+			"permission to list and watch nodes.")
+	c.flags.StringVar(&c.flagServiceIDStrategy, "consul-service-id-strategy", "address",
+		"Defines how the Consul service IDs of ClusterIP and NodePort service instances "+
+			"are generated. Valid options are address, which uses the instance address, "+
+			"and pod-uid, which uses the UID of the pod so IDs aren't reused when a new "+
+			"pod gets the address of an old one.")
+	c.flags.Var(&c.flagSyncPodLabels, "sync-pod-label",
+		"A pod label to add to the service meta of the Consul instances of ClusterIP "+
+			"services backed by the pod, such as \"version\". May be specified multiple "+
+			"times. If this is set then catalog sync watches pods.")
+	c.flags.BoolVar(&c.flagSyncIngresses, "sync-ingresses", false,
+		"If true, Kubernetes ingresses with the \"consul.hashicorp.com/ingress-sync\" "+
+			"annotation set to true are synced to Consul as a service for each host, "+
+			"with the load balancer addresses of the ingress as its instances.")
+	c.flags.BoolVar(&c.flagLeaderElection, "enable-leader-election", false,
+		"If true, multiple replicas of catalog sync can be run and only the elected "+
+			"leader writes to Consul and Kubernetes. The other replicas keep their "+
+			"state up to date so they can take over quickly.")
+	c.flags.StringVar(&c.flagLeaderElectionNS, "leader-election-namespace", "",
+		"The Kubernetes namespace of the ConfigMap used for leader election. This "+
+			"defaults to the namespace catalog sync is running in, from the POD_NAMESPACE "+
+			"environment variable or the service account, or \"default\" if unknown.")
+	c.flags.StringVar(&c.flagLeaderElectionName, "leader-election-name", "consul-k8s-sync-catalog",
+		"The name of the ConfigMap used for leader election. All replicas of the "+
+			"same catalog sync must use the same name.")
+	c.flags.BoolVar(&c.flagDryRun, "dry-run", false,
+		"If true, the services that would be registered or deregistered in Consul "+
+			"and created, updated or deleted in Kubernetes are logged without writing "+
+			"anything. Leader election is disabled and no events are recorded.")
 	c.flags.StringVar(&c.flagLogLevel, "log-level", "info",
 		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 			"\"debug\", \"info\", \"warn\", and \"error\".")
@@ -113,6 +256,35 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if _, err := labels.Parse(c.flagK8SServiceSelector); err != nil {
+		c.UI.Error(fmt.Sprintf("Error parsing -k8s-service-selector: %s", err))
+		return 1
+	}
+	for _, patterns := range [][]string{c.flagAllowK8SNamespaces, c.flagDenyK8SNamespaces} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				c.UI.Error(fmt.Sprintf("Invalid namespace pattern %q: %s", pattern, err))
+				return 1
+			}
+		}
+	}
+	if !c.flagK8SServiceDetails {
+		if c.flagK8SNamespaceMetaKey != "" {
+			c.UI.Error("-k8s-namespace-meta-key requires -k8s-service-details")
+			return 1
+		}
+		if len(c.flagK8SLabelMetaKeys) > 0 {
+			c.UI.Error("-k8s-label-meta-key requires -k8s-service-details")
+			return 1
+		}
+	}
+	switch catalogFromK8S.ServiceIDStrategy(c.flagServiceIDStrategy) {
+	case catalogFromK8S.ServiceIDAddress, catalogFromK8S.ServiceIDPodUID:
+	default:
+		c.UI.Error(fmt.Sprintf("Invalid -consul-service-id-strategy %q", c.flagServiceIDStrategy))
+		return 1
+	}
+
 	config, err := subcommand.K8SConfig(c.k8s.KubeConfig())
 	if err != nil {
 		c.UI.Error(fmt.Sprintf("Error retrieving Kubernetes auth: %s", err))
@@ -147,6 +319,44 @@ func (c *Command) Run(args []string) int {
 	var syncInterval time.Duration
 	c.flagConsulWritePeriod.Merge(&syncInterval)
 
+	// Events are recorded on the Kubernetes resources that fail to sync.
+	// Nothing is written in a dry run, including events.
+	var recorder record.EventRecorder
+	if c.flagDryRun {
+		logger.Info("dry run enabled, nothing will be written to Consul or Kubernetes")
+	} else {
+		recorder = subcommand.EventRecorder(clientset, "consul-k8s-sync-catalog")
+	}
+
+	// Elect a leader if enabled. Only the leader writes to Consul and
+	// Kubernetes. Without leader election we always lead.
+	leadingCh := make(chan struct{})
+	var lostCh <-chan struct{}
+	if c.flagLeaderElection && !c.flagDryRun {
+		namespace := c.flagLeaderElectionNS
+		if namespace == "" {
+			namespace = podNamespace()
+		}
+
+		var leading <-chan struct{}
+		leading, lostCh, err = runLeaderElection(
+			clientset, recorder, namespace, c.flagLeaderElectionName,
+			logger.Named("leader-election"))
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error starting leader election: %s", err))
+			return 1
+		}
+
+		// The controllers only need to know when we start leading, since
+		// we exit if leadership is lost.
+		go func() {
+			<-leading
+			close(leadingCh)
+		}()
+	} else {
+		close(leadingCh)
+	}
+
 	// Create the context we'll use to cancel everything
 	ctx, cancelF := context.WithCancel(context.Background())
 
@@ -155,28 +365,46 @@ func (c *Command) Run(args []string) int {
 	if c.flagToConsul {
 		// Build the Consul sync and start it
 		syncer := &catalogFromK8S.ConsulSyncer{
-			Client:            c.consulClient,
-			Log:               logger.Named("to-consul/sink"),
-			Namespace:         c.flagK8SSourceNamespace,
-			SyncPeriod:        syncInterval,
-			ServicePollPeriod: syncInterval * 2,
-			ConsulK8STag:      c.flagConsulK8STag,
+			Client:        c.consulClient,
+			Log:           logger.Named("to-consul/sink"),
+			Namespace:     c.flagK8SSourceNamespace,
+			SyncPeriod:    syncInterval,
+			ConsulK8STag:  c.flagConsulK8STag,
+			ClusterName:   c.flagK8SClusterName,
+			UseTxn:        c.flagConsulWriteTxn,
+			DryRun:        c.flagDryRun,
+			EventRecorder: recorder,
 		}
-		go syncer.Run(ctx)
+		go func() {
+			select {
+			case <-leadingCh:
+				syncer.Run(ctx)
+			case <-ctx.Done():
+			}
+		}()
 
 		// Build the controller and start it
 		ctl := &controller.Controller{
-			Log: logger.Named("to-consul/controller"),
+			Name: "to-consul",
+			Log:  logger.Named("to-consul/controller"),
 			Resource: &catalogFromK8S.ServiceResource{
 				Log:                 logger.Named("to-consul/source"),
 				Client:              clientset,
 				Syncer:              syncer,
 				Namespace:           c.flagK8SSourceNamespace,
+				AllowK8SNamespaces:  c.flagAllowK8SNamespaces,
+				DenyK8SNamespaces:   c.flagDenyK8SNamespaces,
+				ServiceSelector:     c.flagK8SServiceSelector,
 				ExplicitEnable:      !c.flagK8SDefault,
 				ClusterIPSync:       c.flagSyncClusterIPServices,
 				NodePortSync:        catalogFromK8S.NodePortSyncType(c.flagNodePortSyncType),
+				SyncK8SNodes:        c.flagSyncK8SNodes,
 				ConsulK8STag:        c.flagConsulK8STag,
 				ConsulServicePrefix: c.flagConsulServicePrefix,
+				ClusterName:         c.flagK8SClusterName,
+				SyncIngresses:       c.flagSyncIngresses,
+				ServiceIDStrategy:   catalogFromK8S.ServiceIDStrategy(c.flagServiceIDStrategy),
+				PodLabels:           c.flagSyncPodLabels,
 			},
 		}
 
@@ -190,10 +418,39 @@ func (c *Command) Run(args []string) int {
 	// Start Consul-to-K8S sync
 	var toK8SCh chan struct{}
 	if c.flagToK8S {
+		owner := c.flagK8SOwner
+		if owner == "" {
+			owner = podNamespace()
+		}
+
+		// Consul services that can't be synced at all are reported with
+		// events on our pod.
+		var eventObject runtime.Object
+		if recorder != nil {
+			pod, err := clientset.CoreV1().Pods(podNamespace()).Get(podName(), metav1.GetOptions{})
+			if err != nil {
+				logger.Warn("error getting catalog sync pod, skipped Consul services won't be recorded as events",
+					"err", err)
+			} else {
+				eventObject = pod
+			}
+		}
+
 		sink := &catalogFromConsul.K8SSink{
-			Client:    clientset,
-			Namespace: c.flagK8SWriteNamespace,
-			Log:       logger.Named("to-k8s/sink"),
+			Client:        clientset,
+			Namespace:     c.flagK8SWriteNamespace,
+			Log:           logger.Named("to-k8s/sink"),
+			SyncEndpoints: c.flagK8SSyncEndpoints,
+			EventRecorder: recorder,
+			DryRun:        c.flagDryRun,
+			AdoptServices: c.flagK8SAdoptServices,
+			LabelMetaKeys: c.flagK8SLabelMetaKeys,
+			Owner:         owner,
+			EventObject:   eventObject,
+
+			NamespaceMetaKey:   c.flagK8SNamespaceMetaKey,
+			NamespaceTagPrefix: c.flagK8SNamespaceTagPrefix,
+			NamespacePrefixes:  c.flagK8SNamespacePrefixes,
 		}
 
 		source := &catalogFromConsul.Source{
@@ -203,13 +460,25 @@ func (c *Command) Run(args []string) int {
 			Prefix:       c.flagK8SServicePrefix,
 			Log:          logger.Named("to-k8s/source"),
 			ConsulK8STag: c.flagConsulK8STag,
+			RequireTags:  c.flagConsulRequireTags,
+			ExcludeTags:  c.flagConsulExcludeTags,
+			NodeMeta:     c.flagConsulNodeMeta,
+			Filter:       c.flagConsulFilter,
+			Datacenters:  c.flagConsulDatacenters,
+
+			SyncEndpoints:  c.flagK8SSyncEndpoints,
+			ServiceDetails: c.flagK8SServiceDetails,
 		}
 		go source.Run(ctx)
 
 		// Build the controller and start it
 		ctl := &controller.Controller{
-			Log:      logger.Named("to-k8s/controller"),
-			Resource: sink,
+			Name: "to-k8s",
+			Log:  logger.Named("to-k8s/controller"),
+			Resource: &leaderResource{
+				Resource:  sink,
+				leadingCh: leadingCh,
+			},
 		}
 
 		toK8SCh = make(chan struct{})
@@ -223,6 +492,7 @@ func (c *Command) Run(args []string) int {
 	go func() {
 		mux := http.NewServeMux()
 		mux.HandleFunc("/health/ready", c.handleReady)
+		mux.Handle("/metrics", promhttp.Handler())
 		var handler http.Handler = mux
 
 		c.UI.Info(fmt.Sprintf("Listening on %q...", c.flagListen))
@@ -251,6 +521,18 @@ func (c *Command) Run(args []string) int {
 		}
 		return 1
 
+	// Lost leadership, exit so we restart as a follower
+	case <-lostCh:
+		c.UI.Error("Lost leadership, exiting")
+		cancelF()
+		if toConsulCh != nil {
+			<-toConsulCh
+		}
+		if toK8SCh != nil {
+			<-toK8SCh
+		}
+		return 1
+
 	// Interrupted, gracefully exit
 	case <-sigCh:
 		cancelF()
@@ -0,0 +1,147 @@
+package synccatalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-k8s/helper/controller"
+	"github.com/hashicorp/go-hclog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// leaderLeaseDuration is the time followers wait before forcing a new
+	// leader. leaderRenewDeadline is the time the leader retries renewing
+	// the lock before giving up and leaderRetryPeriod is the time between
+	// attempts to acquire or renew the lock.
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+
+	// serviceAccountNamespaceFile is the file the namespace of the pod is
+	// mounted to along with the service account token.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// podNamespace returns the namespace this process is running in. This is
+// read from the POD_NAMESPACE environment variable, which can be set with
+// the downward API, or else from the service account. If neither is
+// available, then this is the default namespace.
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if b, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if ns := strings.TrimSpace(string(b)); ns != "" {
+			return ns
+		}
+	}
+
+	return metav1.NamespaceDefault
+}
+
+// podName returns the name of the pod this process is running in. This is
+// read from the POD_NAME environment variable, which can be set with the
+// downward API, or else is the hostname, which is the pod name unless the
+// pod sets a hostname.
+func podName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+
+	name, _ := os.Hostname()
+	return name
+}
+
+// runLeaderElection starts leader election using a ConfigMap lock with the
+// given name in the given namespace. Leadership changes are recorded as
+// events on the ConfigMap. The returned leadingCh is closed once
+// this process becomes the leader and lostCh is closed if it then loses
+// leadership, after which it will never lead again and should exit.
+func runLeaderElection(
+	client kubernetes.Interface,
+	recorder record.EventRecorder,
+	namespace, name string,
+	log hclog.Logger,
+) (leadingCh <-chan struct{}, lostCh <-chan struct{}, err error) {
+	id, err := os.Hostname()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting hostname: %s", err)
+	}
+
+	lock, err := resourcelock.New(
+		resourcelock.ConfigMapsResourceLock,
+		namespace,
+		name,
+		client.CoreV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating leader election lock: %s", err)
+	}
+
+	leading := make(chan struct{})
+	lost := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaderLeaseDuration,
+		RenewDeadline: leaderRenewDeadline,
+		RetryPeriod:   leaderRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(<-chan struct{}) {
+				log.Info("started leading", "id", id)
+				close(leading)
+			},
+			OnStoppedLeading: func() {
+				log.Warn("stopped leading", "id", id)
+				close(lost)
+			},
+			OnNewLeader: func(identity string) {
+				log.Info("new leader elected", "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating leader elector: %s", err)
+	}
+
+	// The elector can't be stopped, it runs until leadership is lost.
+	go elector.Run()
+
+	return leading, lost, nil
+}
+
+// leaderResource wraps a controller.Resource so that its background
+// process, which writes to the cluster, only runs once leadingCh is
+// closed. The informer and the Resource callbacks run either way so the
+// state is warm if this process becomes the leader.
+type leaderResource struct {
+	controller.Resource
+
+	leadingCh <-chan struct{}
+}
+
+// Run implements the controller.Backgrounder interface.
+func (r *leaderResource) Run(ch <-chan struct{}) {
+	bg, ok := r.Resource.(controller.Backgrounder)
+	if !ok {
+		return
+	}
+
+	select {
+	case <-r.leadingCh:
+		bg.Run(ch)
+
+	case <-ch:
+	}
+}